@@ -0,0 +1,26 @@
+package certainsync
+
+import (
+	"math/bits"
+
+	"github.com/holiman/uint256"
+)
+
+// modUint64 returns x mod m for a non-zero 64-bit modulus.
+// It reduces x limb by limb (Horner's rule) without allocating.
+func modUint64(x *uint256.Int, m uint64) uint64 {
+	var rem uint64
+	for i := len(x) - 1; i >= 0; i-- {
+		rem = bits.Rem64(rem, x[i], m)
+	}
+	return rem
+}
+
+// divUint64 sets quo to x / m and returns x mod m for a non-zero
+// 64-bit modulus, without allocating.
+func divUint64(quo, x *uint256.Int, m uint64) (rem uint64) {
+	for i := len(x) - 1; i >= 0; i-- {
+		quo[i], rem = bits.Div64(rem, x[i], m)
+	}
+	return rem
+}
@@ -4,111 +4,99 @@ import (
 	"github.com/holiman/uint256"
 )
 
-// Static hasher instance
-var cellHasher CellHasher = nil
-
-// SetHasher selects appropriate hash function based on universe size.
-func SetHasher(universeSize *uint256.Int) {
+// DefaultHasher selects appropriate hash function based on universe size.
+func DefaultHasher(universeSize *uint256.Int) CellHasher {
 	if universeSize.IsUint64() {
-		cellHasher = XXHash64Hash{}
-	} else {
-		cellHasher = Sha256Hash{}
+		return XXHash64Hash{}
 	}
+	return Sha256Hash{}
 }
 
 // IBFCell represents a single cell in the Invertible Bloom Filter.
 // It maintains count, XOR sum of elements, and hash sum for verification.
+// The sums are held inline, so a slice of cells is a single allocation.
+// Cells of superset IBFs leave their hash sum at zero.
 type IBFCell struct {
 	Count   int64
-	XorSum  *uint256.Int
-	HashSum *uint256.Int
+	XorSum  uint256.Int
+	HashSum uint256.Int
 }
 
-// NewIBFCell creates a new initialized IBFCell with
-// appropriate hasher based on universe size
-func NewIBFCell(universeSize *uint256.Int) IBFCell {
-	cell := IBFCell{
-		Count:   0,
-		XorSum:  uint256.NewInt(0),
-		HashSum: uint256.NewInt(0),
-	}
-
-	SetHasher(universeSize)
-	return cell
+// NewIBFCell creates a new initialized IBFCell, the zero cell.
+func NewIBFCell() IBFCell {
+	return IBFCell{}
 }
 
-// Insert adds a symbol to the cell
-func (c *IBFCell) Insert(s *uint256.Int) {
+// Insert adds a symbol to the cell, using h to hash it. Superset
+// cells are given a nil hasher and keep a zero hash sum.
+func (c *IBFCell) Insert(s *uint256.Int, h CellHasher) {
 	if s == nil {
 		return
 	}
 	c.Count++
-	c.XorSum.Xor(c.XorSum, s)
+	c.XorSum.Xor(&c.XorSum, s)
 
-	symbolHash := cellHasher.Hash(s.Bytes())
-	c.HashSum.Xor(c.HashSum, symbolHash)
+	if h == nil {
+		return
+	}
+	symbolHash := h.Hash(s.Bytes())
+	c.HashSum.Xor(&c.HashSum, symbolHash)
 }
 
 // Subtract removes another cell's contents from this cell
-func (c *IBFCell) Subtract(other IBFCell) {
+func (c *IBFCell) Subtract(other *IBFCell) {
 	c.Count -= other.Count
-	c.XorSum.Xor(c.XorSum, other.XorSum)
-	c.HashSum.Xor(c.HashSum, other.HashSum)
+	c.XorSum.Xor(&c.XorSum, &other.XorSum)
+	c.HashSum.Xor(&c.HashSum, &other.HashSum)
+}
+
+// Add adds another cell's contents to this cell
+func (c *IBFCell) Add(other *IBFCell) {
+	c.Count += other.Count
+	c.XorSum.Xor(&c.XorSum, &other.XorSum)
+	c.HashSum.Xor(&c.HashSum, &other.HashSum)
 }
 
 // IsPure checks if the cell contains exactly one element by verifying
-// the count is ±1 and the hash sum matches the computed hash of XorSum
-func (c *IBFCell) IsPure() bool {
+// the count is ±1 and the hash sum matches the hash h computes for XorSum.
+// Counts of superset cells are never negative, so with a nil hasher a
+// count of 1 is enough.
+func (c *IBFCell) IsPure(h CellHasher) bool {
 	if c.Count != 1 && c.Count != -1 {
 		return false
 	}
 
-	calcHashSum := cellHasher.Hash(c.XorSum.Bytes())
-	return c.HashSum.Cmp(calcHashSum) == 0
+	if h == nil {
+		return c.Count == 1
+	}
+
+	calcHashSum := h.Hash(c.XorSum.Bytes())
+	return c.HashSum.Eq(calcHashSum)
 }
 
 // IsZero checks if the cell is empty
 func (c *IBFCell) IsZero() bool {
-	return c.Count == 0 &&
-		c.XorSum.IsZero() &&
-		c.HashSum.IsZero()
+	return c.Count == 0 && c.XorSum.IsZero() && c.HashSum.IsZero()
 }
 
 // GetXorSum returns a copy of the XorSum to prevent external modification
 func (c *IBFCell) GetXorSum() *uint256.Int {
-	return uint256.NewInt(0).Set(c.XorSum)
+	return c.XorSum.Clone()
 }
 
 // Clone creates a deep copy of the cell
 func (c *IBFCell) Clone() IBFCell {
-	return IBFCell{
-		Count:   c.Count,
-		XorSum:  uint256.NewInt(0).Set(c.XorSum),
-		HashSum: uint256.NewInt(0).Set(c.HashSum),
-	}
+	return *c
 }
 
-// ByteLen returns the total size of the cell in bytes.
-func (c *IBFCell) ByteLen() uint8 {
-	// Count (int64)
-	var countBytes uint8 = 8
-
-	var xorSumBytes uint8 = 0
-	var hashSumBytes uint8 = 0
-
-	switch cellHasher.(type) {
-	case XXHash64Hash:
-		xorSumBytes = 8 // 64 bits for XXHash64
-		hashSumBytes = 8
-	case Sha256Hash:
-		xorSumBytes = 32 // 64 bits for Sha256Hash
-		hashSumBytes = 32
-	}
-
-	return countBytes + xorSumBytes + hashSumBytes
+// ByteLen returns the total size of the cell in bytes, rounded up,
+// when stored with layout l, without a hash sum if superset.
+func (c *IBFCell) ByteLen(l CellLayout, superset bool) uint8 {
+	return uint8((c.BitsLen(l, superset) + 7) / 8)
 }
 
-// BitsLen returns the total size of the cell in bits,
-func (c *IBFCell) BitsLen() uint64 {
-	return uint64(c.ByteLen()) * 8
+// BitsLen returns the total size of the cell in bits
+// when stored with layout l, without a hash sum if superset.
+func (c *IBFCell) BitsLen(l CellLayout, superset bool) uint64 {
+	return l.CellBits(superset)
 }
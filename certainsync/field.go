@@ -0,0 +1,237 @@
+package certainsync
+
+import (
+	"math/big"
+	"math/bits"
+)
+
+// maxFieldTableSize bounds the order of the prime power fields whose
+// multiplication goes through log tables. Prime fields need no tables.
+const maxFieldTableSize = 1 << 20
+
+// galoisField implements arithmetic in the finite field GF(q), q = p^k.
+// Elements are the integers in [0, q), whose base p digits are the
+// coefficients of a polynomial over GF(p) (least significant first).
+type galoisField struct {
+	p, k, q uint64
+
+	// Tables of the powers of a primitive element g, used for
+	// multiplication when k > 1: exp[i] = g^i and log[g^i] = i.
+	exp []uint64
+	log []uint64
+}
+
+// newGaloisField returns the field of the smallest prime or prime
+// power order q >= n. Prime powers whose log tables would exceed
+// maxFieldTableSize are skipped in favor of a larger prime.
+func newGaloisField(n uint64) *galoisField {
+	if n < 2 {
+		n = 2
+	}
+
+	for q := n; ; q++ {
+		p, k, ok := primePower(q)
+		if !ok || (k > 1 && q > maxFieldTableSize) {
+			continue
+		}
+
+		f := &galoisField{p: p, k: k, q: q}
+		if k > 1 {
+			f.buildTables()
+		}
+		return f
+	}
+}
+
+// add returns a + b in the field.
+func (f *galoisField) add(a, b uint64) uint64 {
+	if f.k == 1 {
+		sum, carry := bits.Add64(a, b, 0)
+		if carry != 0 || sum >= f.p {
+			sum -= f.p
+		}
+		return sum
+	}
+
+	if f.p == 2 {
+		return a ^ b
+	}
+
+	var sum, place uint64 = 0, 1
+	for i := uint64(0); i < f.k; i++ {
+		digit := (a%f.p + b%f.p) % f.p
+		sum += digit * place
+		a /= f.p
+		b /= f.p
+		place *= f.p
+	}
+	return sum
+}
+
+// mul returns a * b in the field.
+func (f *galoisField) mul(a, b uint64) uint64 {
+	if f.k == 1 {
+		hi, lo := bits.Mul64(a, b)
+		return bits.Rem64(hi, lo, f.p)
+	}
+
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return f.exp[(f.log[a]+f.log[b])%(f.q-1)]
+}
+
+// element returns the field element used for the i-th integer, which
+// is i itself for i < q.
+func (f *galoisField) element(i uint64) uint64 {
+	return i % f.q
+}
+
+// buildTables finds a primitive polynomial of degree k over GF(p)
+// and fills the exp and log tables of its root x.
+func (f *galoisField) buildTables() {
+	f.exp = make([]uint64, f.q-1)
+	f.log = make([]uint64, f.q)
+
+	// Candidate x^k + c(x), where the digits of c are the lower
+	// coefficients. c(0) != 0, or x would divide the polynomial.
+	for c := uint64(1); c < f.q; c++ {
+		if c%f.p == 0 {
+			continue
+		}
+		if f.fillTables(c) {
+			return
+		}
+	}
+
+	// A primitive polynomial of every degree exists over GF(p).
+	panic("certainsync: no primitive polynomial found")
+}
+
+// fillTables fills the exp and log tables with the powers of x modulo
+// x^k + c(x), and reports whether x has order q-1, i.e. whether the
+// polynomial is primitive.
+func (f *galoisField) fillTables(c uint64) bool {
+	lowCoeffs := f.digits(c)
+	digits := make([]uint64, f.k)
+
+	// Start from x^0 = 1
+	digits[0] = 1
+	power := uint64(1)
+
+	for i := uint64(0); i < f.q-1; i++ {
+		if i > 0 && power == 1 {
+			// x has order i < q-1
+			return false
+		}
+		f.exp[i] = power
+		f.log[power] = i
+
+		// Multiply by x: shift the digits up and replace
+		// x^k by -c(x).
+		top := digits[f.k-1]
+		copy(digits[1:], digits[:f.k-1])
+		digits[0] = 0
+		for j := uint64(0); j < f.k; j++ {
+			digits[j] = (digits[j] + (f.p-top)*lowCoeffs[j]) % f.p
+		}
+		power = f.fromDigits(digits)
+	}
+
+	return power == 1
+}
+
+// digits returns the k base p digits of a.
+func (f *galoisField) digits(a uint64) []uint64 {
+	d := make([]uint64, f.k)
+	for i := range d {
+		d[i] = a % f.p
+		a /= f.p
+	}
+	return d
+}
+
+// fromDigits returns the element with the given base p digits.
+func (f *galoisField) fromDigits(d []uint64) uint64 {
+	var a uint64
+	for i := len(d) - 1; i >= 0; i-- {
+		a = a*f.p + d[i]
+	}
+	return a
+}
+
+// primePower reports whether n = p^k for a prime p and k >= 1.
+func primePower(n uint64) (p, k uint64, ok bool) {
+	if n < 2 {
+		return 0, 0, false
+	}
+
+	// ProbablyPrime is exact for numbers below 2^64.
+	if new(big.Int).SetUint64(n).ProbablyPrime(0) {
+		return n, 1, true
+	}
+
+	for k = 2; k < 64 && uint64(1)<<k <= n; k++ {
+		root := integerRoot(n, k)
+		if pow, exact := exactPower(root, k); exact && pow == n &&
+			new(big.Int).SetUint64(root).ProbablyPrime(0) {
+			return root, k, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// integerRoot returns the largest r with r^k <= n.
+func integerRoot(n, k uint64) uint64 {
+	lo, hi := uint64(1), uint64(1)<<(64/k+1)
+	for lo < hi {
+		mid := lo + (hi-lo+1)/2
+		if pow, exact := exactPower(mid, k); exact && pow <= n {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
+
+// exactPower returns r^k, and whether it fits in 64 bits.
+func exactPower(r, k uint64) (uint64, bool) {
+	pow := uint64(1)
+	for i := uint64(0); i < k; i++ {
+		hi, lo := bits.Mul64(pow, r)
+		if hi != 0 {
+			return 0, false
+		}
+		pow = lo
+	}
+	return pow, true
+}
+
+// gf2128 is an element of GF(2^128), a polynomial over GF(2) stored
+// least significant limb first, modulo x^128 + x^7 + x^2 + x + 1.
+type gf2128 [2]uint64
+
+// add returns a + b in GF(2^128).
+func (a gf2128) add(b gf2128) gf2128 {
+	return gf2128{a[0] ^ b[0], a[1] ^ b[1]}
+}
+
+// mulUint64 returns a * b in GF(2^128) for an element b of degree
+// below 64, by shifting and adding.
+func (a gf2128) mulUint64(b uint64) gf2128 {
+	var product gf2128
+	for ; b != 0; b >>= 1 {
+		if b&1 == 1 {
+			product = product.add(a)
+		}
+
+		// Multiply a by x, reducing x^128 to x^7 + x^2 + x + 1
+		carry := a[1] >> 63
+		a[1] = a[1]<<1 | a[0]>>63
+		a[0] <<= 1
+		a[0] ^= carry * 0x87
+	}
+	return product
+}
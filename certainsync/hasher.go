@@ -1,15 +1,40 @@
 package certainsync
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/holiman/uint256"
+	"github.com/spaolacci/murmur3"
+	"golang.org/x/crypto/blake2b"
+)
+
+// SessionSeedSize is the size in bytes of the seeds made by NewSessionSeed.
+const SessionSeedSize = 32
+
+// Hasher names used in the wire format header.
+const (
+	XXHash64HasherName   = "xxhash64"
+	Sha256HasherName     = "sha256"
+	Sha256_64HasherName  = "sha256-64"
+	Sha256_128HasherName = "sha256-128"
+	Murmur3HasherName    = "murmur3-128"
+	Blake2bHasherName    = "blake2b"
 )
 
 // CellHasher is used to compute the hash of the provided data.
 type CellHasher interface {
 	Hash(data []byte) *uint256.Int
+
+	// Name returns the name the hasher is registered with.
+	Name() string
+
+	// Bits returns the width of the hashes, which are below 2^Bits.
+	Bits() uint
 }
 
 // XXHash64Hash implements CellHasher using XXHash64
@@ -20,6 +45,9 @@ func (h XXHash64Hash) Hash(data []byte) *uint256.Int {
 	return uint256.NewInt(hash)
 }
 
+func (h XXHash64Hash) Name() string { return XXHash64HasherName }
+func (h XXHash64Hash) Bits() uint   { return 64 }
+
 // Sha256Hash implements CellHasher using SHA-256
 type Sha256Hash struct{}
 
@@ -27,3 +55,142 @@ func (h Sha256Hash) Hash(data []byte) *uint256.Int {
 	hash := sha256.Sum256(data)
 	return new(uint256.Int).SetBytes(hash[:])
 }
+
+func (h Sha256Hash) Name() string { return Sha256HasherName }
+func (h Sha256Hash) Bits() uint   { return 256 }
+
+// TruncatedSha256Hash implements CellHasher using the first Width
+// bits of SHA-256, for Width a multiple of 8 up to 256.
+type TruncatedSha256Hash struct {
+	Width uint
+}
+
+func (h TruncatedSha256Hash) Hash(data []byte) *uint256.Int {
+	hash := sha256.Sum256(data)
+	return new(uint256.Int).SetBytes(hash[:h.Width/8])
+}
+
+func (h TruncatedSha256Hash) Name() string { return fmt.Sprintf("%s-%d", Sha256HasherName, h.Width) }
+func (h TruncatedSha256Hash) Bits() uint   { return h.Width }
+
+// Murmur3Hash implements CellHasher using the 128-bit MurmurHash3.
+type Murmur3Hash struct{}
+
+func (h Murmur3Hash) Hash(data []byte) *uint256.Int {
+	hi, lo := murmur3.Sum128(data)
+	return &uint256.Int{lo, hi, 0, 0}
+}
+
+func (h Murmur3Hash) Name() string { return Murmur3HasherName }
+func (h Murmur3Hash) Bits() uint   { return 128 }
+
+// Blake2bHash implements CellHasher using BLAKE2b-256 keyed with a
+// secret derived from a session seed. Peers that do not know the seed
+// cannot craft symbols whose hashes make impure cells look pure.
+type Blake2bHash struct {
+	key [blake2b.Size256]byte
+}
+
+// NewBlake2bHash returns a Blake2bHash keyed from the given seed.
+// Both peers of a session must use the same seed.
+func NewBlake2bHash(seed []byte) Blake2bHash {
+	return Blake2bHash{key: blake2b.Sum256(append([]byte("certainsync cell hash key:"), seed...))}
+}
+
+func (h Blake2bHash) Name() string { return Blake2bHasherName }
+func (h Blake2bHash) Bits() uint   { return 256 }
+
+func (h Blake2bHash) Hash(data []byte) *uint256.Int {
+	// New256 only fails on keys longer than 64 bytes.
+	d, _ := blake2b.New256(h.key[:])
+	d.Write(data)
+
+	var hash [blake2b.Size256]byte
+	return new(uint256.Int).SetBytes(d.Sum(hash[:0]))
+}
+
+// NewSessionSeed returns a random seed for NewBlake2bHash.
+func NewSessionSeed() ([]byte, error) {
+	seed := make([]byte, SessionSeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+// hasherRegistry maps hasher names to their constructors.
+var (
+	hasherRegistryMu sync.RWMutex
+	hasherRegistry   = make(map[string]hasherEntry)
+)
+
+// hasherEntry is a registered hasher constructor.
+type hasherEntry struct {
+	newHasher func(seed []byte) CellHasher
+	keyed     bool
+}
+
+func init() {
+	RegisterHasher(XXHash64HasherName, func() CellHasher { return XXHash64Hash{} })
+	RegisterHasher(Sha256HasherName, func() CellHasher { return Sha256Hash{} })
+	RegisterHasher(Sha256_64HasherName, func() CellHasher { return TruncatedSha256Hash{Width: 64} })
+	RegisterHasher(Sha256_128HasherName, func() CellHasher { return TruncatedSha256Hash{Width: 128} })
+	RegisterHasher(Murmur3HasherName, func() CellHasher { return Murmur3Hash{} })
+	RegisterKeyedHasher(Blake2bHasherName, func(seed []byte) CellHasher { return NewBlake2bHash(seed) })
+}
+
+// RegisterHasher makes an unkeyed hasher available by name, to
+// NewHasher and to IBF decoding. It panics if the name is taken or
+// does not match the name of the hashers newHasher returns.
+func RegisterHasher(name string, newHasher func() CellHasher) {
+	registerHasher(name, func([]byte) CellHasher { return newHasher() }, false)
+}
+
+// RegisterKeyedHasher is like RegisterHasher for hashers keyed from
+// a session seed. Their keys are never encoded with IBFs.
+func RegisterKeyedHasher(name string, newHasher func(seed []byte) CellHasher) {
+	registerHasher(name, newHasher, true)
+}
+
+func registerHasher(name string, newHasher func(seed []byte) CellHasher, keyed bool) {
+	if got := newHasher(nil).Name(); got != name {
+		panic(fmt.Sprintf("certainsync: hasher registered as %q is named %q", name, got))
+	}
+
+	hasherRegistryMu.Lock()
+	defer hasherRegistryMu.Unlock()
+
+	if _, ok := hasherRegistry[name]; ok {
+		panic(fmt.Sprintf("certainsync: hasher %q registered twice", name))
+	}
+	hasherRegistry[name] = hasherEntry{newHasher: newHasher, keyed: keyed}
+}
+
+// NewHasher returns the registered hasher with the given name, keyed
+// from seed if it is a keyed hasher.
+func NewHasher(name string, seed []byte) (CellHasher, error) {
+	hasherRegistryMu.RLock()
+	entry, ok := hasherRegistry[name]
+	hasherRegistryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownHasher, name)
+	}
+	if entry.keyed && seed == nil {
+		return nil, fmt.Errorf("%w: %q", ErrMissingHasherKey, name)
+	}
+	return entry.newHasher(seed), nil
+}
+
+// Hashers returns the names of the registered hashers, sorted.
+func Hashers() []string {
+	hasherRegistryMu.RLock()
+	defer hasherRegistryMu.RUnlock()
+
+	names := make([]string, 0, len(hasherRegistry))
+	for name := range hasherRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
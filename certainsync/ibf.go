@@ -1,16 +1,42 @@
 package certainsync
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"unsafe"
 
 	"github.com/holiman/uint256"
 )
 
 // Common errors
 var (
-	ErrInvalidSymbolType = errors.New("invalid symbol type")
-	ErrSizeMismatch      = errors.New("IBF size mismatch")
-	ErrNilIBF            = errors.New("nil IBF reference")
+	ErrInvalidSymbolType   = errors.New("invalid symbol type")
+	ErrSizeMismatch        = errors.New("IBF size mismatch")
+	ErrNilIBF              = errors.New("nil IBF reference")
+	ErrBatchOutOfOrder     = errors.New("cell batch out of order")
+	ErrIterationsExhausted = errors.New("mapping method has no more iterations")
+	ErrUniverseMismatch    = errors.New("IBF universe size mismatch")
+	ErrMappingMismatch     = errors.New("IBF mapping method mismatch")
+	ErrHasherMismatch      = errors.New("IBF hasher mismatch")
+	ErrSupersetMismatch    = errors.New("IBF superset mode mismatch")
+	ErrLayoutMismatch      = errors.New("IBF cell layout mismatch")
+	ErrTooManyCells        = errors.New("IBF cell count too large")
+)
+
+// maxCells bounds the cells of an IBF well below the largest slice
+// Go can allocate, so that growing past it is an error, not a panic.
+const maxCells = uint64(min(math.MaxInt, 1<<47)) / uint64(unsafe.Sizeof(IBFCell{}))
+
+// Decoding errors
+var (
+	ErrNoPureCells         = errors.New("no pure cells to decode")
+	ErrResidualCells       = errors.New("non-zero cells left after decoding")
+	ErrSymbolOutOfUniverse = errors.New("decoded symbol out of universe")
+	ErrSupersetViolation   = errors.New("negative count in superset IBF")
 )
 
 // InvertibleBloomFilter represents the basic CertainSync
@@ -21,145 +47,419 @@ type InvertibleBloomFilter struct {
 	Iteration     uint64        // Current iteration (number of times symbols are added)
 	Size          uint64        // Number of cells in the filter
 	MappingMethod MappingMethod // Method type used for mapping symbols to cells
+	Hasher        CellHasher    // Hasher used for the HashSum of the cells
+	Superset      bool          // Whether cells omit HashSum, see WithSuperset
+	Layout        CellLayout    // Widths of the cell fields
+}
+
+// CellBatch holds the cells added to an IBF by a single iteration.
+type CellBatch struct {
+	Iteration uint64    // Iteration that produced the cells
+	Offset    uint64    // Index of the first cell of the batch in the IBF
+	Cells     []IBFCell // Cells added by the iteration
+	Superset  bool      // Whether the cells have no HashSum, see WithSuperset
+}
+
+// BitsLen returns the total size of the batch cells in bits
+// when stored with layout l.
+func (b CellBatch) BitsLen(l CellLayout) uint64 {
+	return uint64(len(b.Cells)) * l.CellBits(b.Superset)
+}
+
+// IBFOption configures an InvertibleBloomFilter created by NewIBF.
+type IBFOption func(*InvertibleBloomFilter)
+
+// WithHasher overrides the hasher selected from the universe size.
+func WithHasher(h CellHasher) IBFOption {
+	return func(ibf *InvertibleBloomFilter) {
+		ibf.Hasher = h
+	}
+}
+
+// WithSuperset makes the IBF drop the HashSum of its cells, for sets
+// known to contain the sets they are reconciled with. The difference
+// with a subset then has no negative counts, so a count of 1 proves a
+// cell pure. Decoding reports ErrSupersetViolation on negative counts.
+func WithSuperset() IBFOption {
+	return func(ibf *InvertibleBloomFilter) {
+		ibf.Superset = true
+	}
 }
 
 // NewIBF creates a new InvertibleBloomFilter instance.
-func NewIBF(universeSize *uint256.Int, mapping MappingMethod) *InvertibleBloomFilter {
-	return &InvertibleBloomFilter{
+// Unless overridden by an option, the hasher is selected
+// from the universe size by DefaultHasher, and the cell
+// layout is the default one for the universe and hasher.
+func NewIBF(universeSize *uint256.Int, mapping MappingMethod, opts ...IBFOption) *InvertibleBloomFilter {
+	ibf := &InvertibleBloomFilter{
 		Cells:         nil,
 		UniverseSize:  universeSize.Clone(),
 		Iteration:     0,
 		Size:          0,
 		MappingMethod: mapping,
+		Hasher:        DefaultHasher(universeSize),
 	}
+
+	for _, opt := range opts {
+		opt(ibf)
+	}
+
+	ibf.Layout = ibf.Layout.withDefaults(ibf.UniverseSize, ibf.Hasher)
+
+	return ibf
 }
 
 // Copy copies the contents of another IBF into the current IBF.
 func (ibf *InvertibleBloomFilter) Copy(ibf2 *InvertibleBloomFilter) {
-	ibf.Cells = make([]IBFCell, len(ibf2.Cells))
-
-	for i := range ibf.Cells {
-		ibf.Cells[i] = NewIBFCell(ibf2.UniverseSize)
-		ibf.Cells[i] = ibf2.Cells[i].Clone()
-	}
-
+	ibf.Cells = append([]IBFCell(nil), ibf2.Cells...)
 	ibf.UniverseSize = ibf2.UniverseSize.Clone()
 	ibf.Iteration = ibf2.Iteration
 	ibf.Size = ibf2.Size
 	ibf.MappingMethod = ibf2.MappingMethod
+	ibf.Hasher = ibf2.Hasher
+	ibf.Superset = ibf2.Superset
+	ibf.Layout = ibf2.Layout
 }
 
-// AddSymbols adds a list of symbols to the IBF.
-func (ibf *InvertibleBloomFilter) AddSymbols(symbols []*uint256.Int) {
+// checkNextIteration returns ErrIterationsExhausted if the mapping
+// method defines no iteration after the given one.
+func (ibf *InvertibleBloomFilter) checkNextIteration(iteration uint64) error {
+	bounded, ok := ibf.MappingMethod.(BoundedMappingMethod)
+	if ok && iteration >= bounded.MaxIterations() {
+		return fmt.Errorf("%w: %T defines %d iterations",
+			ErrIterationsExhausted, ibf.MappingMethod, bounded.MaxIterations())
+	}
+	return nil
+}
+
+// AddSymbols adds a list of symbols to the IBF and returns the
+// cells added by this iteration. The batch shares its cells with
+// the IBF. It returns ErrIterationsExhausted once a bounded mapping
+// method has no more iterations, and ErrTooManyCells if the cells of
+// the iteration cannot be allocated.
+func (ibf *InvertibleBloomFilter) AddSymbols(symbols []*uint256.Int) (CellBatch, error) {
+	if err := ibf.checkNextIteration(ibf.Iteration); err != nil {
+		return CellBatch{}, err
+	}
+
+	additionalCellsCount := ibf.MappingMethod.GetAdditionalCellsCount(ibf.Iteration + 1)
+	if err := ibf.growCells(additionalCellsCount); err != nil {
+		return CellBatch{}, fmt.Errorf("iteration %d: %w", ibf.Iteration+1, err)
+	}
 	ibf.Iteration++
-	additionalCellsCount := ibf.MappingMethod.GetAdditionalCellsCount(ibf.Iteration)
 
-	// Expand the cell array if needed
-	if ibf.Size+additionalCellsCount > uint64(len(ibf.Cells)) {
-		newCapacity := ibf.Size + additionalCellsCount
+	// Add symbols to cells, unless the mapping has no
+	// cells for this iteration
+	if additionalCellsCount > 0 {
+		cellIndices := make([]uint64, 0, 1)
+		hasher := ibf.cellHasher()
 
-		newCells := make([]IBFCell, newCapacity)
+		for _, s := range symbols {
+			cellIndices = appendSymbolCells(cellIndices[:0], ibf.MappingMethod, s, ibf.Iteration)
 
-		for i := range newCells {
-			newCells[i] = NewIBFCell(ibf.UniverseSize)
+			for _, cellIdx := range cellIndices {
+				ibf.Cells[ibf.Size+cellIdx].Insert(s, hasher)
+			}
 		}
 
-		copy(newCells, ibf.Cells)
+		ibf.wrapCells(ibf.Cells[ibf.Size : ibf.Size+additionalCellsCount])
+	}
 
-		ibf.Cells = newCells
+	end := ibf.Size + additionalCellsCount
+	batch := CellBatch{
+		Iteration: ibf.Iteration,
+		Offset:    ibf.Size,
+		Cells:     ibf.Cells[ibf.Size:end:end],
+		Superset:  ibf.Superset,
 	}
 
-	// Add symbols to cells
-	for _, s := range symbols {
-		j := ibf.Size + ibf.MappingMethod.MapSymbol(s, ibf.Iteration)
-		ibf.Cells[j].Insert(s)
+	ibf.Size += additionalCellsCount
+
+	return batch, nil
+}
+
+// growCells appends n zero cells after the first Size cells. The
+// storage grows geometrically, so over many iterations each cell is
+// copied a constant number of times on average.
+func (ibf *InvertibleBloomFilter) growCells(n uint64) error {
+	if err := ibf.checkCells(n); err != nil {
+		return err
 	}
+	cells := slices.Grow(ibf.Cells[:ibf.Size], int(n))
+	cells = cells[:ibf.Size+n]
+	clear(cells[ibf.Size:])
+	ibf.Cells = cells
+	return nil
+}
+
+// checkCells returns ErrTooManyCells if n cells cannot be added to
+// the first Size cells.
+func (ibf *InvertibleBloomFilter) checkCells(n uint64) error {
+	if n > maxCells-ibf.Size {
+		return fmt.Errorf("%w: %d cells added to %d, at most %d", ErrTooManyCells, n, ibf.Size, maxCells)
+	}
+	return nil
+}
 
+// Reserve makes room for the cells of the next iterations, so that
+// adding them does not move the cells. The mapping's bound on the
+// iterations is taken into account. It returns ErrTooManyCells, and
+// reserves nothing, if the cells cannot be allocated.
+func (ibf *InvertibleBloomFilter) Reserve(iterations uint64) error {
+	last := ibf.Iteration + iterations
+	if last < ibf.Iteration {
+		last = math.MaxUint64
+	}
+	if bounded, ok := ibf.MappingMethod.(BoundedMappingMethod); ok {
+		last = min(last, bounded.MaxIterations())
+	}
+
+	n := uint64(0)
+	for i := ibf.Iteration + 1; i <= last && i != 0; i++ {
+		// Capped, so that the sum cannot overflow before it is checked.
+		n += min(ibf.MappingMethod.GetAdditionalCellsCount(i), maxCells)
+		if err := ibf.checkCells(n); err != nil {
+			return err
+		}
+	}
+
+	ibf.Cells = slices.Grow(ibf.Cells[:ibf.Size], int(n))
+	return nil
+}
+
+// ApplyBatch appends a batch of cells received from a remote IBF,
+// so that the IBF mirrors the remote one. Batches must be applied
+// in iteration order.
+func (ibf *InvertibleBloomFilter) ApplyBatch(batch CellBatch) error {
+	if batch.Iteration != ibf.Iteration+1 || batch.Offset != ibf.Size {
+		return fmt.Errorf("%w: got iteration %d at offset %d, want iteration %d at offset %d",
+			ErrBatchOutOfOrder, batch.Iteration, batch.Offset, ibf.Iteration+1, ibf.Size)
+	}
+
+	if err := ibf.checkNextIteration(ibf.Iteration); err != nil {
+		return err
+	}
+
+	additionalCellsCount := ibf.MappingMethod.GetAdditionalCellsCount(batch.Iteration)
+	if uint64(len(batch.Cells)) != additionalCellsCount {
+		return fmt.Errorf("%w: iteration %d has %d cells, want %d",
+			ErrSizeMismatch, batch.Iteration, len(batch.Cells), additionalCellsCount)
+	}
+
+	if batch.Superset != ibf.Superset {
+		return fmt.Errorf("%w: iteration %d has superset %t, want %t",
+			ErrSupersetMismatch, batch.Iteration, batch.Superset, ibf.Superset)
+	}
+
+	// Drop any cells past Size before appending
+	ibf.Cells = append(ibf.Cells[:ibf.Size], batch.Cells...)
+	ibf.Iteration = batch.Iteration
 	ibf.Size += additionalCellsCount
+
+	return nil
 }
 
 // Subtract subtracts another IBF from the current one.
 func (ibf *InvertibleBloomFilter) Subtract(ibf2 *InvertibleBloomFilter) *InvertibleBloomFilter {
-	difference := NewIBF(ibf.UniverseSize, ibf.MappingMethod)
+	difference := NewIBF(ibf.UniverseSize, ibf.MappingMethod, WithHasher(ibf.Hasher))
 	difference.Copy(ibf)
+	difference.subtractCells(ibf2, 0, ibf.Size)
+
+	return difference
+}
+
+// SubtractInPlace subtracts another IBF from the current one without
+// copying it, after the same checks as SubtractChecked.
+func (ibf *InvertibleBloomFilter) SubtractInPlace(other *InvertibleBloomFilter) error {
+	if err := ibf.CheckCompatible(other); err != nil {
+		return fmt.Errorf("subtract: %w", err)
+	}
+	ibf.subtractCells(other, 0, ibf.Size)
+	return nil
+}
+
+// SubtractRange subtracts the cells [from, to) of another IBF from the
+// same cells of the current one, e.g. the cells of the last iteration
+// only. The other IBF may have fewer iterations, as long as it holds
+// the range.
+func (ibf *InvertibleBloomFilter) SubtractRange(other *InvertibleBloomFilter, from, to uint64) error {
+	if err := ibf.checkRange(other, from, to); err != nil {
+		return fmt.Errorf("subtract: %w", err)
+	}
+	ibf.subtractCells(other, from, to)
+	return nil
+}
 
+// Add adds the cells of another IBF to the current one in place, so
+// that the IBF is the one of the multiset union of both sets. It makes
+// the same checks as SubtractChecked.
+func (ibf *InvertibleBloomFilter) Add(other *InvertibleBloomFilter) error {
+	if err := ibf.CheckCompatible(other); err != nil {
+		return fmt.Errorf("add: %w", err)
+	}
 	for j := uint64(0); j < ibf.Size; j++ {
-		difference.Cells[j].Subtract(ibf2.Cells[j])
+		ibf.Cells[j].Add(&other.Cells[j])
 	}
+	ibf.wrapCells(ibf.Cells[:ibf.Size])
+	return nil
+}
 
-	return difference
+// subtractCells subtracts the cells [from, to) of other in place.
+func (ibf *InvertibleBloomFilter) subtractCells(other *InvertibleBloomFilter, from, to uint64) {
+	for j := from; j < to; j++ {
+		ibf.Cells[j].Subtract(&other.Cells[j])
+	}
+	ibf.wrapCells(ibf.Cells[from:to])
 }
 
-// Decode attempts to extract the symbols unique to each set represented by the IBF.
-// bWithoutA: Symbols in the second set but not in the first.
-// aWithoutB: Symbols in the first set but not in the second.
-// ok: Whether decoding was successful.
-func (ibf *InvertibleBloomFilter) Decode() (bWithoutA []*uint256.Int, aWithoutB []*uint256.Int, ok bool) {
-	pureList := make([]uint64, 0)
+// SubtractChecked subtracts another IBF from the current one after
+// checking that both IBFs have the same size, iterations, universe,
+// mapping method and hasher.
+func (ibf *InvertibleBloomFilter) SubtractChecked(other *InvertibleBloomFilter) (*InvertibleBloomFilter, error) {
+	if err := ibf.CheckCompatible(other); err != nil {
+		return nil, fmt.Errorf("subtract: %w", err)
+	}
+	return ibf.Subtract(other), nil
+}
 
-	for {
-		n := len(pureList) - 1
+// CheckCompatible checks that cells of another IBF can be combined
+// with the cells of the current one.
+func (ibf *InvertibleBloomFilter) CheckCompatible(other *InvertibleBloomFilter) error {
+	if ibf == nil || other == nil {
+		return ErrNilIBF
+	}
 
-		if n == -1 {
-			// Identify pure cells
-			for j := uint64(0); j < ibf.Size; j++ {
-				if ibf.Cells[j].IsPure() {
-					pureList = append(pureList, j)
-				}
-			}
-			if len(pureList) == 0 {
-				break
-			}
-			continue
-		}
+	if ibf.Size != other.Size || ibf.Iteration != other.Iteration {
+		return fmt.Errorf("%w: %d cells in %d iterations, other has %d cells in %d iterations",
+			ErrSizeMismatch, ibf.Size, ibf.Iteration, other.Size, other.Iteration)
+	}
 
-		j := pureList[n]
-		pureList = pureList[:n]
+	if uint64(len(ibf.Cells)) < ibf.Size || uint64(len(other.Cells)) < other.Size {
+		return fmt.Errorf("%w: %d cells allocated, other has %d, want %d",
+			ErrSizeMismatch, len(ibf.Cells), len(other.Cells), ibf.Size)
+	}
 
-		if !ibf.Cells[j].IsPure() {
-			continue
-		}
+	return ibf.checkCellsCompatible(other)
+}
 
-		xorSum := ibf.Cells[j].GetXorSum()
+// checkRange checks that the cells [from, to) of another IBF can be
+// combined with the same cells of the current one.
+func (ibf *InvertibleBloomFilter) checkRange(other *InvertibleBloomFilter, from, to uint64) error {
+	if ibf == nil || other == nil {
+		return ErrNilIBF
+	}
 
-		if ibf.Cells[j].Count > 0 {
-			bWithoutA = append(bWithoutA, xorSum)
-		} else {
-			aWithoutB = append(aWithoutB, xorSum)
-		}
+	if from > to || to > min(ibf.Size, other.Size) ||
+		uint64(len(ibf.Cells)) < to || uint64(len(other.Cells)) < to {
+		return fmt.Errorf("%w: cells [%d, %d) out of %d cells, other has %d",
+			ErrSizeMismatch, from, to, ibf.Size, other.Size)
+	}
 
-		offset := uint64(0)
-		// Removed symbol (xorSum) from cells its mapped to.
-		for i := uint64(1); i <= ibf.Iteration; i++ {
-			cellIdx := offset + ibf.MappingMethod.MapSymbol(xorSum, i)
+	return ibf.checkCellsCompatible(other)
+}
 
-			// Empty the pure cell at index j at the end
-			if cellIdx != j {
-				ibf.Cells[cellIdx].Subtract(ibf.Cells[j])
-			}
+// checkCellsCompatible checks that the cells of another IBF are built
+// the same way as the cells of the current one.
+func (ibf *InvertibleBloomFilter) checkCellsCompatible(other *InvertibleBloomFilter) error {
+	if !ibf.UniverseSize.Eq(other.UniverseSize) {
+		return fmt.Errorf("%w: %s, other has %s",
+			ErrUniverseMismatch, ibf.UniverseSize.Dec(), other.UniverseSize.Dec())
+	}
 
-			offset += ibf.MappingMethod.GetAdditionalCellsCount(i)
-		}
+	if !sameMapping(ibf.MappingMethod, other.MappingMethod) {
+		return fmt.Errorf("%w: %T, other has %T",
+			ErrMappingMismatch, ibf.MappingMethod, other.MappingMethod)
+	}
 
-		ibf.Cells[j].Subtract(ibf.Cells[j])
+	if !sameHasher(ibf.Hasher, other.Hasher) {
+		return fmt.Errorf("%w: %T, other has %T", ErrHasherMismatch, ibf.Hasher, other.Hasher)
 	}
 
-	// Verify the IBF is empty after decoding
-	for j := uint64(0); j < ibf.Size; j++ {
-		if !ibf.Cells[j].IsZero() {
-			ok = false
-			return
-		}
+	if ibf.Superset != other.Superset {
+		return fmt.Errorf("%w: superset is %t, other has %t", ErrSupersetMismatch, ibf.Superset, other.Superset)
+	}
+
+	if ibf.Layout != other.Layout {
+		return fmt.Errorf("%w: %+v, other has %+v", ErrLayoutMismatch, ibf.Layout, other.Layout)
 	}
 
-	ok = true
-	return
+	return nil
+}
+
+// sameMapping reports whether two mapping methods map symbols the
+// same way: they are the same instance or have equal descriptors.
+func sameMapping(m1, m2 MappingMethod) bool {
+	if m1 == m2 {
+		return true
+	}
+
+	d1, err1 := DescribeMapping(m1)
+	d2, err2 := DescribeMapping(m2)
+	return err1 == nil && err2 == nil &&
+		d1.Name == d2.Name && bytes.Equal(d1.Params, d2.Params)
+}
+
+// sameHasher reports whether two hashers are of the same type
+// and, if comparable, equal.
+func sameHasher(h1, h2 CellHasher) bool {
+	t1, t2 := reflect.TypeOf(h1), reflect.TypeOf(h2)
+	if t1 != t2 {
+		return false
+	}
+	return t1 == nil || !t1.Comparable() || h1 == h2
+}
+
+// Decode attempts to extract the symbols unique to each set represented by the IBF.
+// bWithoutA: Symbols in the second set but not in the first.
+// aWithoutB: Symbols in the first set but not in the second.
+// ok: Whether decoding was successful.
+func (ibf *InvertibleBloomFilter) Decode() (bWithoutA []*uint256.Int, aWithoutB []*uint256.Int, ok bool) {
+	bWithoutA, aWithoutB, err := ibf.DecodeChecked()
+	return bWithoutA, aWithoutB, err == nil
+}
+
+// DecodeChecked is like Decode, but reports why decoding failed:
+// ErrNoPureCells if no symbol could be peeled, ErrResidualCells if
+// peeling stopped with non-zero cells left, and ErrSymbolOutOfUniverse
+// if a cell that looked pure held a symbol outside the universe.
+// Superset IBFs fail with ErrSupersetViolation on negative counts.
+// The symbols recovered before the failure are returned with the error.
+func (ibf *InvertibleBloomFilter) DecodeChecked() (bWithoutA []*uint256.Int, aWithoutB []*uint256.Int, err error) {
+	result, err := ibf.DecodeDetailed()
+	return result.BWithoutA, result.AWithoutB, err
+}
+
+// DecodeResult describes the outcome of peeling an IBF.
+type DecodeResult struct {
+	// Symbols in the second set but not in the first.
+	BWithoutA []*uint256.Int
+	// Symbols in the first set but not in the second.
+	AWithoutB []*uint256.Int
+
+	// Number of symbols peeled.
+	PeelingSteps uint64
+	// Number of cells that looked pure but held a symbol not mapped
+	// to them, and so were left in place.
+	FalsePurities uint64
+
+	// Non-zero cells left in each iteration, indexed by iteration - 1.
+	ResidualCells []uint64
+	// Iterations with non-zero cells left.
+	UndecodableIterations []uint64
+}
+
+// DecodeDetailed is like DecodeChecked, but also reports how peeling
+// went and where it got stuck. Only the cells touched by a peel are
+// checked for purity again, so decoding takes time linear in the
+// number of cells and the cells of the recovered symbols.
+func (ibf *InvertibleBloomFilter) DecodeDetailed() (*DecodeResult, error) {
+	return newIncrementalDecoderFor(ibf).Decode()
 }
 
 // IsEmpty checks if the IBF is empty or not.
 func (ibf *InvertibleBloomFilter) IsEmpty() bool {
-	for _, cell := range ibf.Cells {
-		if !cell.IsZero() {
+	for j := range ibf.Cells {
+		if !ibf.Cells[j].IsZero() {
 			return false
 		}
 	}
@@ -167,11 +467,8 @@ func (ibf *InvertibleBloomFilter) IsEmpty() bool {
 }
 
 // GetTransmittedBitsSize calculates the bit size of all transmitted cells.
-// This size reflects only the cells used by the IBF.
+// This size reflects only the cells used by the IBF. Use CellBatch.BitsLen
+// to account for the cells of a single iteration.
 func (ibf *InvertibleBloomFilter) GetTransmittedBitsSize() uint64 {
-	var totalSize uint64
-	for _, cell := range ibf.Cells {
-		totalSize += cell.BitsLen()
-	}
-	return totalSize
+	return uint64(len(ibf.Cells)) * ibf.Layout.CellBits(ibf.Superset)
 }
@@ -0,0 +1,309 @@
+package certainsync
+
+import (
+	"fmt"
+
+	"github.com/holiman/uint256"
+)
+
+// IncrementalDecoder peels a difference IBF one iteration at a time.
+// It keeps the peeled cells and the recovered symbols between
+// iterations, so each new iteration only costs its own cells and the
+// symbols it releases, instead of a full Subtract and Decode.
+type IncrementalDecoder struct {
+	diff *InvertibleBloomFilter
+
+	// offsets[i-1] is the index of the first cell of iteration i.
+	offsets []uint64
+
+	result    DecodeResult
+	falsePure map[uint64]bool
+	violation error
+
+	// Cells to check for purity on the next Decode, each queued once.
+	pending []uint64
+	queued  []bool
+
+	cellIndices []uint64
+	symbolCells []uint64
+	// Iteration of each cell in symbolCells.
+	symbolIterations []uint64
+}
+
+// NewIncrementalDecoder creates a decoder for the difference of two
+// IBFs with the given universe, mapping method and options.
+func NewIncrementalDecoder(universeSize *uint256.Int, mappingMethod MappingMethod, opts ...IBFOption) *IncrementalDecoder {
+	return &IncrementalDecoder{
+		diff:      NewIBF(universeSize, mappingMethod, opts...),
+		falsePure: make(map[uint64]bool),
+	}
+}
+
+// newIncrementalDecoderFor returns a decoder that peels the cells of
+// ibf in place, with all of its iterations added.
+func newIncrementalDecoderFor(ibf *InvertibleBloomFilter) *IncrementalDecoder {
+	d := &IncrementalDecoder{
+		diff:      ibf,
+		offsets:   make([]uint64, 0, ibf.Iteration),
+		falsePure: make(map[uint64]bool),
+		queued:    make([]bool, ibf.Size),
+	}
+	d.result.ResidualCells = make([]uint64, ibf.Iteration)
+
+	offset := uint64(0)
+	for i := uint64(1); i <= ibf.Iteration; i++ {
+		d.offsets = append(d.offsets, offset)
+		offset = min(offset+ibf.MappingMethod.GetAdditionalCellsCount(i), ibf.Size)
+		d.checkCells(d.offsets[i-1], offset)
+	}
+
+	return d
+}
+
+// Iteration returns the number of iterations added to the decoder.
+func (d *IncrementalDecoder) Iteration() uint64 {
+	return d.diff.Iteration
+}
+
+// AddBatches adds the cells of batch b minus those of batch a for the
+// next iteration, like Subtract does for whole IBFs: symbols only in
+// b's set are recovered in BWithoutA. The symbols recovered so far are
+// removed from the new cells right away.
+func (d *IncrementalDecoder) AddBatches(b, a CellBatch) error {
+	if a.Iteration != b.Iteration || a.Offset != b.Offset {
+		return fmt.Errorf("%w: got iteration %d at offset %d, other batch has iteration %d at offset %d",
+			ErrBatchOutOfOrder, b.Iteration, b.Offset, a.Iteration, a.Offset)
+	}
+
+	if len(a.Cells) != len(b.Cells) {
+		return fmt.Errorf("%w: batch has %d cells, other batch has %d",
+			ErrSizeMismatch, len(b.Cells), len(a.Cells))
+	}
+
+	if a.Superset != d.diff.Superset {
+		return fmt.Errorf("%w: other batch has superset %t, want %t",
+			ErrSupersetMismatch, a.Superset, d.diff.Superset)
+	}
+
+	offset := d.diff.Size
+	if err := d.diff.ApplyBatch(b); err != nil {
+		return err
+	}
+	d.offsets = append(d.offsets, offset)
+	d.result.ResidualCells = append(d.result.ResidualCells, 0)
+	d.queued = append(d.queued, make([]bool, d.diff.Size-offset)...)
+
+	for j := offset; j < d.diff.Size; j++ {
+		d.diff.Cells[j].Subtract(&a.Cells[j-offset])
+	}
+
+	// Remove the recovered symbols from the new cells.
+	hasher := d.diff.cellHasher()
+	d.removeFromIteration(d.result.BWithoutA, 1, hasher)
+	d.removeFromIteration(d.result.AWithoutB, -1, hasher)
+	d.diff.wrapCells(d.diff.Cells[offset:d.diff.Size])
+
+	d.checkCells(offset, d.diff.Size)
+
+	return nil
+}
+
+// checkCells counts the non-zero cells in [from, to), which belong to
+// the last iteration added, and queues those that may be pure.
+func (d *IncrementalDecoder) checkCells(from, to uint64) {
+	iteration := uint64(len(d.offsets))
+	for j := from; j < to; j++ {
+		if !d.diff.Cells[j].IsZero() {
+			d.result.ResidualCells[iteration-1]++
+			d.checkSuperset(j)
+			d.queue(j)
+		}
+	}
+}
+
+// checkSuperset records a violation of the superset assumption if
+// cell j of a superset IBF has a negative count.
+func (d *IncrementalDecoder) checkSuperset(j uint64) {
+	if d.diff.Superset && d.diff.Cells[j].Count < 0 && d.violation == nil {
+		d.violation = fmt.Errorf("%w: cell %d has count %d",
+			ErrSupersetViolation, j, d.diff.Cells[j].Count)
+	}
+}
+
+// queue adds cell j to the cells to check for purity, unless it is
+// already queued or its count rules purity out.
+func (d *IncrementalDecoder) queue(j uint64) {
+	count := d.diff.Cells[j].Count
+	if d.queued[j] || (count != 1 && count != -1) {
+		return
+	}
+	d.queued[j] = true
+	d.pending = append(d.pending, j)
+}
+
+// removeFromIteration removes symbols counted with the given sign
+// from the cells of the last iteration.
+func (d *IncrementalDecoder) removeFromIteration(symbols []*uint256.Int, sign int64, hasher CellHasher) {
+	iteration := d.diff.Iteration
+	offset := d.offsets[iteration-1]
+
+	for _, s := range symbols {
+		var cell IBFCell
+		cell.Insert(s, hasher)
+		cell.Count = sign
+
+		d.cellIndices = appendSymbolCells(d.cellIndices[:0], d.diff.MappingMethod, s, iteration)
+		for _, cellIdx := range d.cellIndices {
+			d.diff.Cells[offset+cellIdx].Subtract(&cell)
+		}
+	}
+}
+
+// Decode peels the cells changed since the last call and reports the
+// symbols recovered over all iterations so far. It fails with the
+// same errors as DecodeChecked while non-zero cells are left; adding
+// more iterations may then let decoding go on.
+func (d *IncrementalDecoder) Decode() (*DecodeResult, error) {
+	var outOfUniverse error
+	hasher := d.diff.cellHasher()
+
+	for len(d.pending) > 0 {
+		n := len(d.pending) - 1
+		j := d.pending[n]
+		d.pending = d.pending[:n]
+		d.queued[j] = false
+
+		if !d.diff.Cells[j].IsPure(hasher) {
+			continue
+		}
+
+		xorSum := d.diff.Cells[j].GetXorSum()
+
+		if xorSum.IsZero() || xorSum.Gt(d.diff.UniverseSize) {
+			outOfUniverse = fmt.Errorf("%w: cell %d holds %s, universe size is %s",
+				ErrSymbolOutOfUniverse, j, xorSum.Hex(), d.diff.UniverseSize.Dec())
+			continue
+		}
+
+		mapped, err := d.mapSymbol(xorSum, j)
+		if err != nil {
+			return d.snapshot(), err
+		}
+		if !mapped {
+			if !d.falsePure[j] {
+				d.falsePure[j] = true
+				d.result.FalsePurities++
+			}
+			continue
+		}
+
+		// Copy the pure cell, as it is subtracted from itself.
+		pure := d.diff.Cells[j]
+		if pure.Count > 0 {
+			d.result.BWithoutA = append(d.result.BWithoutA, xorSum)
+		} else {
+			d.result.AWithoutB = append(d.result.AWithoutB, xorSum)
+		}
+
+		// Removed symbol (xorSum) from cells its mapped to, and
+		// check them again.
+		for k, cellIdx := range d.symbolCells {
+			wasZero := d.diff.Cells[cellIdx].IsZero()
+			d.diff.Cells[cellIdx].Subtract(&pure)
+			d.diff.wrapCells(d.diff.Cells[cellIdx : cellIdx+1])
+			isZero := d.diff.Cells[cellIdx].IsZero()
+
+			residual := &d.result.ResidualCells[d.symbolIterations[k]-1]
+			if wasZero && !isZero {
+				*residual++
+			} else if !wasZero && isZero {
+				*residual--
+			}
+
+			if !isZero {
+				d.checkSuperset(cellIdx)
+				d.queue(cellIdx)
+			}
+		}
+
+		d.result.PeelingSteps++
+	}
+
+	result := d.snapshot()
+
+	residual := uint64(0)
+	for _, count := range result.ResidualCells {
+		residual += count
+	}
+
+	switch {
+	case d.violation != nil:
+		return result, d.violation
+	case residual == 0:
+		return result, nil
+	case outOfUniverse != nil:
+		return result, outOfUniverse
+	case result.PeelingSteps == 0:
+		return result, fmt.Errorf("%w: %d of %d cells are non-zero", ErrNoPureCells, residual, d.diff.Size)
+	default:
+		return result, fmt.Errorf("%w: %d of %d cells are non-zero after recovering %d symbols",
+			ErrResidualCells, residual, d.diff.Size, result.PeelingSteps)
+	}
+}
+
+// mapSymbol sets symbolCells to the cells s is mapped to in all
+// iterations, and reports whether cell j is one of them. It fails with
+// ErrMalformedIBF if s is mapped past the cells of an iteration, as in
+// IBFs with fewer cells than their iterations have.
+func (d *IncrementalDecoder) mapSymbol(s *uint256.Int, j uint64) (bool, error) {
+	d.symbolCells = d.symbolCells[:0]
+	d.symbolIterations = d.symbolIterations[:0]
+	mappedToJ := false
+
+	for i := uint64(1); i <= d.diff.Iteration; i++ {
+		count := d.cellsCount(i)
+		if count == 0 {
+			continue
+		}
+
+		d.cellIndices = appendSymbolCells(d.cellIndices[:0], d.diff.MappingMethod, s, i)
+		for _, cellIdx := range d.cellIndices {
+			if cellIdx >= count {
+				return false, fmt.Errorf("%w: symbol mapped to cell %d of iteration %d, which has %d",
+					ErrMalformedIBF, cellIdx, i, count)
+			}
+			cellIdx += d.offsets[i-1]
+			mappedToJ = mappedToJ || cellIdx == j
+			d.symbolCells = append(d.symbolCells, cellIdx)
+			d.symbolIterations = append(d.symbolIterations, i)
+		}
+	}
+
+	return mappedToJ, nil
+}
+
+// cellsCount returns the number of cells of iteration i.
+func (d *IncrementalDecoder) cellsCount(i uint64) uint64 {
+	if i == uint64(len(d.offsets)) {
+		return d.diff.Size - d.offsets[i-1]
+	}
+	return d.offsets[i] - d.offsets[i-1]
+}
+
+// snapshot returns a copy of the decoding result that later calls
+// will not modify.
+func (d *IncrementalDecoder) snapshot() *DecodeResult {
+	result := d.result
+	result.BWithoutA = result.BWithoutA[:len(result.BWithoutA):len(result.BWithoutA)]
+	result.AWithoutB = result.AWithoutB[:len(result.AWithoutB):len(result.AWithoutB)]
+	result.ResidualCells = append([]uint64(nil), result.ResidualCells...)
+
+	result.UndecodableIterations = nil
+	for i, count := range result.ResidualCells {
+		if count > 0 {
+			result.UndecodableIterations = append(result.UndecodableIterations, uint64(i)+1)
+		}
+	}
+
+	return &result
+}
@@ -0,0 +1,155 @@
+package certainsync
+
+import (
+	"math"
+
+	"github.com/holiman/uint256"
+)
+
+// maxCountBits is the width of the in-memory cell count.
+const maxCountBits = 64
+
+// CellLayout holds the widths in bits of the fields of a cell, as
+// stored on the wire and accounted for in transmitted bits.
+type CellLayout struct {
+	CountBits   uint // Counts wrap modulo 2^CountBits
+	XorSumBits  uint // Enough for the largest symbol of the universe
+	HashSumBits uint // Hashes are truncated to their low HashSumBits bits
+}
+
+// defaultLayout returns the layout used for unset widths: a full
+// count, a XorSum as wide as the universe size and untruncated hashes.
+func defaultLayout(universeSize *uint256.Int, h CellHasher) CellLayout {
+	return CellLayout{
+		CountBits:   maxCountBits,
+		XorSumBits:  uint(max(universeSize.BitLen(), 1)),
+		HashSumBits: h.Bits(),
+	}
+}
+
+// withDefaults fills the unset widths of the layout from defaultLayout,
+// and caps HashSumBits to the width of the hasher.
+func (l CellLayout) withDefaults(universeSize *uint256.Int, h CellHasher) CellLayout {
+	defaults := defaultLayout(universeSize, h)
+	if l.CountBits == 0 || l.CountBits > maxCountBits {
+		l.CountBits = defaults.CountBits
+	}
+	if l.XorSumBits == 0 {
+		l.XorSumBits = defaults.XorSumBits
+	}
+	if l.HashSumBits == 0 || l.HashSumBits > defaults.HashSumBits {
+		l.HashSumBits = defaults.HashSumBits
+	}
+	return l
+}
+
+// CellBits returns the size in bits of a cell, which has no HashSum
+// in superset IBFs.
+func (l CellLayout) CellBits(superset bool) uint64 {
+	bits := uint64(l.CountBits + l.XorSumBits)
+	if !superset {
+		bits += uint64(l.HashSumBits)
+	}
+	return bits
+}
+
+// wrapCount reduces a count modulo 2^CountBits, to the range
+// [-2^(CountBits-1), 2^(CountBits-1)).
+func (l CellLayout) wrapCount(count int64) int64 {
+	if l.CountBits == 0 || l.CountBits >= maxCountBits {
+		return count
+	}
+	shift := maxCountBits - l.CountBits
+	return count << shift >> shift
+}
+
+// CountBitsForSetSize returns the count width that holds the count
+// of any difference cell of sets with at most n symbols without
+// wrapping, i.e. counts in [-n, n].
+func CountBitsForSetSize(n uint64) uint {
+	return uint(uint256.NewInt(n).BitLen()) + 1
+}
+
+// HashSumBitsForFalsePurity returns the HashSum width for which an
+// impure cell with a count of ±1 passes the hash check with
+// probability at most p.
+func HashSumBitsForFalsePurity(p float64) uint {
+	if p <= 0 || p >= 1 {
+		return 0
+	}
+	return uint(math.Ceil(-math.Log2(p)))
+}
+
+// WithCountBits sets the width of the cell counts.
+func WithCountBits(bits uint) IBFOption {
+	return func(ibf *InvertibleBloomFilter) {
+		ibf.Layout.CountBits = bits
+	}
+}
+
+// WithMaxSetSize sets the width of the cell counts from the size of
+// the largest set reconciled, see CountBitsForSetSize.
+func WithMaxSetSize(n uint64) IBFOption {
+	return WithCountBits(CountBitsForSetSize(n))
+}
+
+// WithHashSumBits sets the width of the cell hash sums, up to the
+// width of the hasher.
+func WithHashSumBits(bits uint) IBFOption {
+	return func(ibf *InvertibleBloomFilter) {
+		ibf.Layout.HashSumBits = bits
+	}
+}
+
+// WithFalsePurityProbability sets the width of the cell hash sums
+// from a target false-purity probability, see HashSumBitsForFalsePurity.
+func WithFalsePurityProbability(p float64) IBFOption {
+	return WithHashSumBits(HashSumBitsForFalsePurity(p))
+}
+
+// truncatedHasher keeps the low bits of the hashes of a CellHasher.
+type truncatedHasher struct {
+	h    CellHasher
+	bits uint
+	mask uint256.Int
+}
+
+// TruncateHasher returns a hasher that keeps the low bits of the
+// hashes of h, as IBFs do for a HashSumBits below the hasher width.
+func TruncateHasher(h CellHasher, bits uint) CellHasher {
+	if bits == 0 || bits >= h.Bits() {
+		return h
+	}
+
+	t := &truncatedHasher{h: h, bits: bits}
+	t.mask.Lsh(uint256.NewInt(1), bits)
+	t.mask.SubUint64(&t.mask, 1)
+	return t
+}
+
+func (t *truncatedHasher) Hash(data []byte) *uint256.Int {
+	hash := t.h.Hash(data)
+	return hash.And(hash, &t.mask)
+}
+
+func (t *truncatedHasher) Name() string { return t.h.Name() }
+func (t *truncatedHasher) Bits() uint   { return t.bits }
+
+// cellHasher returns the hasher to use for the HashSum of the cells,
+// truncated to the layout's HashSumBits, or nil for superset IBFs.
+func (ibf *InvertibleBloomFilter) cellHasher() CellHasher {
+	if ibf.Superset {
+		return nil
+	}
+	return TruncateHasher(ibf.Hasher, ibf.Layout.HashSumBits)
+}
+
+// wrapCells reduces the counts of the given cells by the layout.
+func (ibf *InvertibleBloomFilter) wrapCells(cells []IBFCell) {
+	if ibf.Layout.CountBits == 0 || ibf.Layout.CountBits >= maxCountBits {
+		return
+	}
+	for i := range cells {
+		cells[i].Count = ibf.Layout.wrapCount(cells[i].Count)
+	}
+}
@@ -1,6 +1,11 @@
 package certainsync
 
-import "github.com/holiman/uint256"
+import (
+	"math"
+	"sync"
+
+	"github.com/holiman/uint256"
+)
 
 // MappingMethod is an interface for defining symbol-to-cell mapping methods.
 // It provides methods for determining the target cell for a given symbol
@@ -13,49 +18,349 @@ type MappingMethod interface {
 	GetAdditionalCellsCount(iteration uint64) uint64
 }
 
+// BoundedMappingMethod is implemented by mapping methods that define
+// only a finite number of iterations.
+type BoundedMappingMethod interface {
+	MappingMethod
+	// MaxIterations returns the number of iterations the mapping defines.
+	MaxIterations() uint64
+}
+
+// MultiMappingMethod is implemented by mapping methods that map a symbol
+// to a set of cells in each iteration, such as disjunct matrices or
+// generic sparse binary matrices. The IBF uses MapSymbolMulti instead
+// of MapSymbol for these mappings.
+type MultiMappingMethod interface {
+	MappingMethod
+	// MapSymbolMulti maps a symbol to the distinct cells it is added to
+	// for the given iteration.
+	MapSymbolMulti(s *uint256.Int, iteration uint64) []uint64
+}
+
+// AsMultiMapping adapts a mapping method to MultiMappingMethod.
+// Single-cell mappings map each symbol to a set of one cell.
+func AsMultiMapping(m MappingMethod) MultiMappingMethod {
+	if multi, ok := m.(MultiMappingMethod); ok {
+		return multi
+	}
+	return singleCellMapping{m}
+}
+
+// singleCellMapping adapts a single-cell mapping method
+// to MultiMappingMethod.
+type singleCellMapping struct {
+	MappingMethod
+}
+
+// MapSymbolMulti returns the single cell the symbol is mapped to.
+func (m singleCellMapping) MapSymbolMulti(s *uint256.Int, iteration uint64) []uint64 {
+	return []uint64{m.MapSymbol(s, iteration)}
+}
+
+// appendSymbolCells appends the cells a symbol is mapped to in the
+// given iteration to dst, without allocating for single-cell mappings.
+func appendSymbolCells(dst []uint64, m MappingMethod, s *uint256.Int, iteration uint64) []uint64 {
+	if multi, ok := m.(MultiMappingMethod); ok {
+		return append(dst, multi.MapSymbolMulti(s, iteration)...)
+	}
+	return append(dst, m.MapSymbol(s, iteration))
+}
+
 // EGHMapping is a mapping method using a prime-based modulo operation.
-type EGHMapping struct{}
+type EGHMapping struct {
+	Primes *PrimeSource // Source of the primes, nil for the shared default
+}
+
+// prime returns the prime used by the given iteration. Iterations
+// start at 1, and iteration 0 panics rather than sieving forever for
+// the prime at index MaxUint64.
+func (e *EGHMapping) prime(iteration uint64) uint64 {
+	if iteration == 0 {
+		panic("certainsync: EGH iterations start at 1")
+	}
+	primes := e.Primes
+	if primes == nil {
+		primes = defaultPrimeSource
+	}
+	return primes.Prime(iteration - 1)
+}
 
-// MapSymbol maps a symbol based on the current prime in the primes array.
+// MapSymbol maps a symbol based on the prime of the iteration.
 func (e *EGHMapping) MapSymbol(s *uint256.Int, iteration uint64) uint64 {
-	curPrime := primes[iteration-1]
-	modResult := new(uint256.Int).Mod(s, uint256.NewInt(curPrime))
-	return modResult.Uint64()
+	return modUint64(s, e.prime(iteration))
 }
 
 // GetAdditionalCellsCount returns the additional cell count based
-// on the current prime.
+// on the prime of the iteration.
 func (e *EGHMapping) GetAdditionalCellsCount(iteration uint64) uint64 {
-	curPrime := primes[iteration-1]
+	curPrime := e.prime(iteration)
 	return curPrime
 }
 
+// maxOLSCells is the largest order q of an OLSMapping whose lines
+// get a cell each, about 288 MB of cells per iteration.
+const maxOLSCells = 1 << 22
+
+// defaultOLSFoldedCells is the number of cells per iteration of
+// a folded OLSMapping with no Cells set.
+const defaultOLSFoldedCells = 1 << 10
+
 // OLSMapping is a mapping method using an Orthogonal Latin Square approach.
+// The squares are built over the finite field GF(q), where q is the
+// smallest prime or prime power not below Order, so the first iteration
+// maps symbols by row and the next q iterations by the q-1 mutually
+// orthogonal Latin squares L_a(row, col) = a*row + col and the columns.
+// Orders that do not fit in 64 bits, such as the 2^128 order of a 256-bit
+// universe, use GF(2^128), whose squares hold every 256-bit symbol.
+//
+// Squares of order q beyond 2^22 would need more cells per iteration than
+// is practical, so their lines are folded into Cells cells per iteration.
+// Folded squares keep the IBF size practical, but they give up the listing
+// guarantee of OLS: symbols of distinct lines may share a cell.
 type OLSMapping struct {
-	Order uint64 // Order of each Latin square
+	Order *uint256.Int // Requested order of each Latin square
+	Cells uint64       // Cells per iteration of folded squares
+
+	once   sync.Once
+	field  *galoisField // Field of 64-bit orders, nil for GF(2^128)
+	cells  uint64       // Cells per iteration
+	folded bool         // Whether lines are folded into cells
+}
+
+// NewOLSMapping creates an OLSMapping for the given requested order
+// and builds its field arithmetic up front.
+func NewOLSMapping(order *uint256.Int) *OLSMapping {
+	o := &OLSMapping{Order: order}
+	o.init()
+	return o
+}
+
+// OLSOrderForUniverse returns the order of the Latin squares needed to
+// hold a universe, ceil(sqrt(universeSize)).
+func OLSOrderForUniverse(universeSize *uint256.Int) *uint256.Int {
+	order := new(uint256.Int).Sqrt(universeSize)
+
+	var square uint256.Int
+	if square.Mul(order, order).Lt(universeSize) {
+		order.AddUint64(order, 1)
+	}
+	return order
+}
+
+// init builds the field of the Latin squares on first use.
+func (o *OLSMapping) init() {
+	o.once.Do(func() {
+		if o.Order == nil || o.Order.IsUint64() {
+			var order uint64
+			if o.Order != nil {
+				order = o.Order.Uint64()
+			}
+			o.field = newGaloisField(order)
+			if o.field.q <= maxOLSCells {
+				o.cells = o.field.q
+				return
+			}
+		}
+
+		o.folded = true
+		o.cells = o.Cells
+		if o.cells == 0 {
+			o.cells = defaultOLSFoldedCells
+		}
+	})
+}
+
+// FieldOrder returns the order q of the Latin squares, which is Order
+// rounded up to the next prime or prime power, or 2^128 for orders
+// beyond 64 bits.
+func (o *OLSMapping) FieldOrder() *uint256.Int {
+	o.init()
+	if o.field == nil {
+		return new(uint256.Int).Lsh(uint256.NewInt(1), 128)
+	}
+	return uint256.NewInt(o.field.q)
+}
+
+// Folded reports whether lines are folded into Cells cells per
+// iteration, see OLSMapping.
+func (o *OLSMapping) Folded() bool {
+	o.init()
+	return o.folded
+}
+
+// MaxIterations returns q+1, the number of parallel classes (rows,
+// columns and q-1 Latin squares) of the affine plane of order q.
+// GF(2^128) is limited only by the 64-bit iteration counter.
+func (o *OLSMapping) MaxIterations() uint64 {
+	o.init()
+	if o.field == nil {
+		return math.MaxUint64
+	}
+	return o.field.q + 1
 }
 
 // MapSymbol maps a symbol using the OLS method for a given iteration.
 func (o *OLSMapping) MapSymbol(symbol *uint256.Int, iteration uint64) uint64 {
+	o.init()
 	latinSquareNum := iteration - 1
 
 	// Copy symbol and subtract 1 (simulating `symbol - 1`).
-	symbolIndex := new(uint256.Int).Sub(symbol, uint256.NewInt(1))
+	var symbolIndex uint256.Int
+	symbolIndex.SubUint64(symbol, 1)
+
+	if o.field == nil {
+		return o.mapSymbolWide(&symbolIndex, latinSquareNum)
+	}
+
+	field := o.field
 
 	// Calculate row and column for the symbol in the Latin square.
-	row := new(uint256.Int).Div(symbolIndex, uint256.NewInt(o.Order)).Uint64()
-	col := new(uint256.Int).Mod(symbolIndex, uint256.NewInt(o.Order)).Uint64()
+	// Rows past the square are folded back into it.
+	var rowIndex uint256.Int
+	col := divUint64(&rowIndex, &symbolIndex, field.q)
+	row := modUint64(&rowIndex, field.q)
 
-	if latinSquareNum == 0 {
-		return row
+	line := row
+	if latinSquareNum != 0 {
+		// Iteration q+1 uses a = q, that is the zero element, which
+		// maps symbols by column.
+		a := field.element(latinSquareNum)
+		line = field.add(field.mul(a, row), col)
 	}
 
-	// Calculate mapped value for non-zero Latin square numbers.
-	mappedValue := (col + (row * latinSquareNum)) % o.Order
-	return mappedValue
+	if o.folded {
+		return line % o.cells
+	}
+	return line
 }
 
-// GetAdditionalCellsCount returns the order of the Latin square.
+// mapSymbolWide maps a symbol index in the squares of GF(2^128), whose
+// row and column are the high and low 128 bits of the index, and folds
+// the line into the cells of the iteration.
+func (o *OLSMapping) mapSymbolWide(symbolIndex *uint256.Int, latinSquareNum uint64) uint64 {
+	row := gf2128{symbolIndex[2], symbolIndex[3]}
+	col := gf2128{symbolIndex[0], symbolIndex[1]}
+
+	line := row
+	if latinSquareNum != 0 {
+		line = row.mulUint64(latinSquareNum).add(col)
+	}
+
+	folded := uint256.Int{line[0], line[1], 0, 0}
+	return modUint64(&folded, o.cells)
+}
+
+// GetAdditionalCellsCount returns the order of the Latin square,
+// or the number of cells of folded squares.
 func (o *OLSMapping) GetAdditionalCellsCount(iteration uint64) uint64 {
-	return o.Order
+	o.init()
+	return o.cells
+}
+
+// ExtendedHammingMapping is a mapping method using the parity check
+// matrix of an extended Hamming code. The first iteration maps every
+// symbol to a single cell, and iteration i > 1 splits the symbols into
+// two cells by alternating blocks of period 2^(i-2), so each symbol
+// lands in exactly one of the two cells. The mapping defines only
+// the iterations whose period does not exceed the universe size.
+type ExtendedHammingMapping struct {
+	UniverseSize *uint256.Int // Size of the universe, nil for 2^256
+}
+
+// MapSymbol maps a symbol by the bit of its index selected by
+// the iteration.
+func (e *ExtendedHammingMapping) MapSymbol(s *uint256.Int, iteration uint64) uint64 {
+	if iteration == 1 {
+		return 0
+	}
+
+	// Symbol index in 0 indexing
+	var symbolIndex uint256.Int
+	symbolIndex.SubUint64(s, 1)
+
+	bit := iteration - 2
+	if bit >= 256 {
+		return 1
+	}
+
+	// The first cell holds the second half of every block
+	// and the second cell holds the first half.
+	return 1 - (symbolIndex[bit/64]>>(bit%64))&1
+}
+
+// GetAdditionalCellsCount returns one cell for the first iteration,
+// and two cells for every following iteration whose block period
+// does not exceed the universe size.
+func (e *ExtendedHammingMapping) GetAdditionalCellsCount(iteration uint64) uint64 {
+	if iteration == 1 {
+		return 1
+	}
+	if iteration <= e.MaxIterations() {
+		return 2
+	}
+	return 0
+}
+
+// MaxIterations returns the number of iterations with cells. The period
+// 2^(iteration-2) is at most the universe size while iteration-2 is
+// below its bit length.
+func (e *ExtendedHammingMapping) MaxIterations() uint64 {
+	universeBits := uint64(256)
+	if e.UniverseSize != nil {
+		universeBits = uint64(e.UniverseSize.BitLen())
+	}
+	return universeBits + 1
+}
+
+// SparseBlock is the part of a sparse binary mapping matrix
+// used by a single iteration.
+type SparseBlock struct {
+	Rows    uint64     // Number of cells (rows) in the block
+	Columns [][]uint64 // Distinct rows set in each column, one column per symbol
+}
+
+// SparseMatrixMapping is a mapping method using a sparse binary
+// matrix given block by block, one block per iteration. Symbol s
+// is mapped to the rows set in column s-1 of each block. Both peers
+// must build the same matrix, as it has no mapping descriptor.
+type SparseMatrixMapping struct {
+	Blocks []SparseBlock // Matrix block of each iteration
+}
+
+// MapSymbolMulti maps a symbol to the rows set in its column.
+// Symbols outside the matrix are not mapped to any cell.
+func (m *SparseMatrixMapping) MapSymbolMulti(s *uint256.Int, iteration uint64) []uint64 {
+	if iteration > uint64(len(m.Blocks)) || !s.IsUint64() || s.IsZero() {
+		return nil
+	}
+
+	columns := m.Blocks[iteration-1].Columns
+	if column := s.Uint64() - 1; column < uint64(len(columns)) {
+		return columns[column]
+	}
+	return nil
+}
+
+// MapSymbol returns the first row set in the column of the symbol,
+// or 0 if the column is empty. The IBF uses MapSymbolMulti instead.
+func (m *SparseMatrixMapping) MapSymbol(s *uint256.Int, iteration uint64) uint64 {
+	rows := m.MapSymbolMulti(s, iteration)
+	if len(rows) == 0 {
+		return 0
+	}
+	return rows[0]
+}
+
+// MaxIterations returns the number of blocks of the matrix.
+func (m *SparseMatrixMapping) MaxIterations() uint64 {
+	return uint64(len(m.Blocks))
+}
+
+// GetAdditionalCellsCount returns the number of rows in the block
+// of the iteration, or 0 once the matrix is exhausted.
+func (m *SparseMatrixMapping) GetAdditionalCellsCount(iteration uint64) uint64 {
+	if iteration > uint64(len(m.Blocks)) {
+		return 0
+	}
+	return m.Blocks[iteration-1].Rows
 }
@@ -0,0 +1,107 @@
+package certainsync
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// initialSieveLimit is the bound of the first, plain sieve.
+	initialSieveLimit = 1 << 12
+
+	// maxSegmentSize bounds the size of each sieved segment.
+	maxSegmentSize = 1 << 20
+)
+
+// defaultPrimeSource is shared by mappings that do not set their own
+// PrimeSource. It sieves nothing until the first prime is requested.
+var defaultPrimeSource = NewPrimeSource()
+
+// PrimeSource lazily generates the sequence of prime numbers with a
+// segmented sieve of Eratosthenes, extending it only as far as it is
+// requested. It is safe for concurrent use.
+type PrimeSource struct {
+	mu     sync.Mutex
+	primes []uint64 // All primes below limit, in increasing order
+	limit  uint64   // Upper bound (exclusive) of the sieved range
+
+	// Snapshot of primes for lock-free reads. Sieving only appends,
+	// so the primes of a snapshot never change.
+	sieved atomic.Pointer[[]uint64]
+}
+
+// NewPrimeSource creates a new PrimeSource.
+func NewPrimeSource() *PrimeSource {
+	return &PrimeSource{}
+}
+
+// Prime returns the prime at index i (0 based), so Prime(0) is 2.
+func (ps *PrimeSource) Prime(i uint64) uint64 {
+	if sieved := ps.sieved.Load(); sieved != nil && i < uint64(len(*sieved)) {
+		return (*sieved)[i]
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for i >= uint64(len(ps.primes)) {
+		ps.extend()
+	}
+
+	primes := ps.primes
+	ps.sieved.Store(&primes)
+
+	return ps.primes[i]
+}
+
+// extend sieves the next segment of numbers.
+// The caller must hold the lock.
+func (ps *PrimeSource) extend() {
+	if ps.limit == 0 {
+		ps.sieveInitial()
+		return
+	}
+
+	low := ps.limit
+	high := low + min(low, maxSegmentSize)
+
+	// Every base prime up to sqrt(high) is below low, as high <= 2*low.
+	composite := make([]bool, high-low)
+	for _, p := range ps.primes {
+		if p*p >= high {
+			break
+		}
+
+		// First multiple of p in the segment
+		start := (low + p - 1) / p * p
+		for m := start; m < high; m += p {
+			composite[m-low] = true
+		}
+	}
+
+	for k, isComposite := range composite {
+		if !isComposite {
+			ps.primes = append(ps.primes, low+uint64(k))
+		}
+	}
+
+	ps.limit = high
+}
+
+// sieveInitial sieves the primes below initialSieveLimit.
+func (ps *PrimeSource) sieveInitial() {
+	composite := make([]bool, initialSieveLimit)
+
+	for n := uint64(2); n < initialSieveLimit; n++ {
+		if composite[n] {
+			continue
+		}
+
+		ps.primes = append(ps.primes, n)
+		for m := n * n; m < initialSieveLimit; m += n {
+			composite[m] = true
+		}
+	}
+
+	ps.limit = initialSieveLimit
+}
@@ -0,0 +1,310 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/holiman/uint256"
+	"github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+// ProtocolVersion is the version of the session protocol sent in Hello.
+const ProtocolVersion uint8 = 1
+
+// ErrRejected is returned when the receiver rejects the parameters of
+// the sender and the fallback parameters, if it proposed any.
+var ErrRejected = errors.New("session parameters rejected")
+
+// Params describe the IBFs of a session, so that the receiver
+// builds IBFs whose cells line up with the sender's.
+type Params struct {
+	UniverseSize *uint256.Int
+	Mapping      certainsync.MappingDescriptor
+	Hasher       string
+	// Seed keys keyed hashers for the session. In a Hello it is the
+	// nonce of the sender, and once the parameters are accepted, the
+	// seed derived from it and the nonce of the receiver.
+	Seed     []byte
+	Superset bool
+	Layout   certainsync.CellLayout
+}
+
+// ParamsOf returns the parameters of ibf, with no seed.
+func ParamsOf(ibf *certainsync.InvertibleBloomFilter) (Params, error) {
+	mapping, err := certainsync.DescribeMapping(ibf.MappingMethod)
+	if err != nil {
+		return Params{}, err
+	}
+	return Params{
+		UniverseSize: ibf.UniverseSize.Clone(),
+		Mapping:      mapping,
+		Hasher:       ibf.Hasher.Name(),
+		Superset:     ibf.Superset,
+		Layout:       ibf.Layout,
+	}, nil
+}
+
+// options returns the IBF options that give an IBF these parameters.
+func (p Params) options() ([]certainsync.IBFOption, error) {
+	hasher, err := certainsync.NewHasher(p.Hasher, p.Seed)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []certainsync.IBFOption{
+		certainsync.WithHasher(hasher),
+		certainsync.WithCountBits(p.Layout.CountBits),
+		certainsync.WithHashSumBits(p.Layout.HashSumBits),
+	}
+	if p.Superset {
+		opts = append(opts, certainsync.WithSuperset())
+	}
+	return opts, nil
+}
+
+// build returns the mapping method and IBF options of IBFs with these
+// parameters, and checks that they give IBFs the layout of p.
+func (p Params) build() (certainsync.MappingMethod, []certainsync.IBFOption, error) {
+	mapping, err := p.Mapping.NewMapping()
+	if err != nil {
+		return nil, nil, err
+	}
+	opts, err := p.options()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if layout := certainsync.NewIBF(p.UniverseSize, mapping, opts...).Layout; layout != p.Layout {
+		return nil, nil, fmt.Errorf("%w: got %+v, IBFs have %+v",
+			certainsync.ErrLayoutMismatch, p.Layout, layout)
+	}
+	return mapping, opts, nil
+}
+
+// withLayoutOf returns p with the layout IBFs built from it have,
+// keeping the count and HashSum widths where the hasher allows.
+func (p Params) withLayoutOf() (Params, error) {
+	mapping, err := p.Mapping.NewMapping()
+	if err != nil {
+		return p, err
+	}
+	opts, err := p.options()
+	if err != nil {
+		return p, err
+	}
+	p.Layout = certainsync.NewIBF(p.UniverseSize, mapping, opts...).Layout
+	return p, nil
+}
+
+// ReceiverOption configures a Receiver created by NewReceiver.
+type ReceiverOption func(*Receiver)
+
+// AcceptMappings restricts the mapping methods the receiver accepts
+// to the given names, e.g. certainsync.EGHMappingName. All known
+// mappings are accepted by default.
+func AcceptMappings(names ...string) ReceiverOption {
+	return func(r *Receiver) {
+		r.mappings = names
+	}
+}
+
+// AcceptHashers restricts the cell hashers the receiver accepts to
+// the given names. All registered hashers are accepted by default.
+func AcceptHashers(names ...string) ReceiverOption {
+	return func(r *Receiver) {
+		r.hashers = names
+	}
+}
+
+// acceptsMapping reports whether the receiver accepts the mapping.
+func (r *Receiver) acceptsMapping(name string) bool {
+	return r.mappings == nil || contains(r.mappings, name)
+}
+
+// acceptsHasher reports whether the receiver accepts the hasher.
+func (r *Receiver) acceptsHasher(name string) bool {
+	return r.hashers == nil || contains(r.hashers, name)
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate checks the Hello of a sender, and returns a Reject with
+// the reasons and, if it can, fallback parameters to accept instead.
+func (r *Receiver) negotiate(hello Hello) *Reject {
+	if hello.Version != ProtocolVersion {
+		return &Reject{Reason: fmt.Sprintf("protocol version %d, want %d", hello.Version, ProtocolVersion)}
+	}
+
+	p := hello.Params
+	fallback := p
+	var reasons []string
+
+	// Mappings are tied to the universe, so the fallback for a universe
+	// that does not hold the receiver's set is EGH over a larger one.
+	if largest := largestSymbol(r.symbols); largest.Gt(p.UniverseSize) {
+		reasons = append(reasons, fmt.Sprintf("universe %s does not hold %s", p.UniverseSize.Dec(), largest.Dec()))
+		fallback.UniverseSize = largest
+		fallback.Mapping = certainsync.MappingDescriptor{Name: certainsync.EGHMappingName}
+	}
+
+	if !r.acceptsMapping(p.Mapping.Name) {
+		reasons = append(reasons, fmt.Sprintf("mapping %q not supported", p.Mapping.Name))
+		fallback.Mapping = certainsync.MappingDescriptor{Name: certainsync.EGHMappingName}
+	} else if mapping, err := p.Mapping.NewMapping(); err != nil {
+		reasons = append(reasons, err.Error())
+		fallback.Mapping = certainsync.MappingDescriptor{Name: certainsync.EGHMappingName}
+	} else if cells := mapping.GetAdditionalCellsCount(1); r.Limits.MaxCells != 0 && cells > r.Limits.MaxCells {
+		// A single batch of the mapping would not fit, whereas EGH
+		// starts with a few cells.
+		reasons = append(reasons, fmt.Sprintf("mapping %q adds %d cells per iteration, at most %d",
+			p.Mapping.Name, cells, r.Limits.MaxCells))
+		fallback.Mapping = certainsync.MappingDescriptor{Name: certainsync.EGHMappingName}
+	}
+
+	if !r.acceptsHasher(p.Hasher) {
+		reasons = append(reasons, fmt.Sprintf("hasher %q not supported", p.Hasher))
+		fallback.Hasher = r.fallbackHasher(fallback.UniverseSize)
+	} else if _, err := certainsync.NewHasher(p.Hasher, p.Seed); err != nil {
+		reasons = append(reasons, err.Error())
+		fallback.Hasher = r.fallbackHasher(fallback.UniverseSize)
+	}
+
+	if len(reasons) == 0 {
+		_, _, err := p.build()
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+
+	reject := &Reject{Reason: strings.Join(reasons, "; ")}
+	if !r.acceptsMapping(fallback.Mapping.Name) || !r.acceptsHasher(fallback.Hasher) {
+		return reject
+	}
+	if fallback, err := fallback.withLayoutOf(); err == nil {
+		reject.Fallback = &fallback
+	}
+	return reject
+}
+
+// fallbackHasher returns the hasher to propose instead of a rejected
+// one: the default hasher for the universe if it is accepted, or else
+// the first accepted unkeyed hasher.
+func (r *Receiver) fallbackHasher(universeSize *uint256.Int) string {
+	if name := certainsync.DefaultHasher(universeSize).Name(); r.acceptsHasher(name) {
+		return name
+	}
+	for _, name := range r.hashers {
+		if _, err := certainsync.NewHasher(name, nil); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// largestSymbol returns the largest symbol of a set, 0 if it is empty.
+func largestSymbol(symbols []*uint256.Int) *uint256.Int {
+	largest := new(uint256.Int)
+	for _, s := range symbols {
+		if s.Gt(largest) {
+			largest = s
+		}
+	}
+	return largest
+}
+
+// handshake sends the parameters of the sender until the receiver
+// accepts them, falling back once to the parameters it proposes.
+func (s *Sender) handshake(conn *Conn, params Params) (Params, error) {
+	for attempt := 0; ; attempt++ {
+		if err := conn.WriteMessage(Hello{Version: ProtocolVersion, Params: params}); err != nil {
+			return params, err
+		}
+
+		m, err := conn.ReadMessage()
+		if err != nil {
+			return params, err
+		}
+		switch m := m.(type) {
+		case Accept:
+			params.Seed = sessionSeed(params.Seed, m.Nonce)
+			return params, nil
+		case Reject:
+			if m.Fallback == nil || attempt > 0 {
+				return params, fmt.Errorf("%w: %s", ErrRejected, m.Reason)
+			}
+			// The receiver only knows its own set, so the fallback
+			// universe may not hold the sender's.
+			if largest := largestSymbol(s.symbols); largest.Gt(m.Fallback.UniverseSize) {
+				return params, fmt.Errorf("%w: %s, and fallback universe %s does not hold %s",
+					ErrRejected, m.Reason, m.Fallback.UniverseSize.Dec(), largest.Dec())
+			}
+			// The sender keeps its nonce.
+			seed := params.Seed
+			params = *m.Fallback
+			params.Seed = seed
+		default:
+			return params, fmt.Errorf("%w: got %T, want %T or %T", ErrUnexpectedMessage, m, Accept{}, Reject{})
+		}
+	}
+}
+
+// handshake waits for parameters of the sender it accepts, proposing
+// fallback parameters once.
+func (r *Receiver) handshake(conn *Conn) (Params, error) {
+	for attempt := 0; ; attempt++ {
+		m, err := conn.ReadMessage()
+		if err != nil {
+			return Params{}, err
+		}
+		hello, ok := m.(Hello)
+		if !ok {
+			return Params{}, fmt.Errorf("%w: got %T, want %T", ErrUnexpectedMessage, m, hello)
+		}
+
+		reject := r.negotiate(hello)
+		if reject == nil {
+			// The receiver adds a nonce of its own, so that the
+			// sender does not pick the key of keyed hashers alone.
+			nonce, err := certainsync.NewSessionSeed()
+			if err != nil {
+				return hello.Params, err
+			}
+			params := hello.Params
+			params.Seed = sessionSeed(hello.Params.Seed, nonce)
+			return params, conn.WriteMessage(Accept{Nonce: nonce})
+		}
+		if attempt > 0 {
+			reject.Fallback = nil
+		}
+		if err := conn.WriteMessage(*reject); err != nil {
+			return hello.Params, err
+		}
+		if reject.Fallback == nil {
+			return hello.Params, fmt.Errorf("%w: %s", ErrRejected, reject.Reason)
+		}
+	}
+}
+
+// sessionSeed returns the seed of a session, derived from the nonces
+// of the sender and the receiver, so that neither peer picks it.
+func sessionSeed(senderNonce, receiverNonce []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("certainsync session seed"))
+	for _, nonce := range [][]byte{senderNonce, receiverNonce} {
+		var n [binary.MaxVarintLen64]byte
+		h.Write(n[:binary.PutUvarint(n[:], uint64(len(nonce)))])
+		h.Write(nonce)
+	}
+	return h.Sum(nil)
+}
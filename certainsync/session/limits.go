@@ -0,0 +1,177 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/holiman/uint256"
+)
+
+// Limit errors, returned when a session hits the limit of the same
+// name. Message size is limited with ErrMessageTooLarge.
+var (
+	ErrIterationLimit = errors.New("session iteration limit reached")
+	ErrCellLimit      = errors.New("session cell limit reached")
+	ErrSymbolLimit    = errors.New("session decoded symbol limit reached")
+	ErrDeadline       = errors.New("session deadline exceeded")
+)
+
+// Limits bound the resources of a session, so that a malicious or
+// buggy peer cannot make it run forever or grow its IBF without bound.
+// A zero field means no limit, except for MaxMessageSize.
+//
+// A session that hits a limit is stopped: the receiver sends Stop and
+// ends the session with an incomplete DiffList of what it decoded so
+// far. Only the deadline and message size limits abort the session on
+// the spot. Either way, the Result holds the partial difference.
+type Limits struct {
+	// Maximum number of cell batches sent or received.
+	MaxIterations uint64
+	// Maximum number of cells of the IBF.
+	MaxCells uint64
+	// Maximum number of symbols of the decoded difference.
+	MaxDecodedSymbols int
+	// Maximum payload size of a message read, 64 MiB by default.
+	MaxMessageSize uint64
+	// Maximum duration of the session.
+	Timeout time.Duration
+}
+
+// deadliner is implemented by streams with deadlines, such as net.Conn.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// limiter enforces the limits of a session, and its cancellation.
+type limiter struct {
+	Limits
+	ctx      context.Context
+	rw       io.ReadWriter
+	deadline time.Time
+
+	stopCancel func() bool
+	// Guards the deadline of rw once ctx may be cancelled.
+	mu          sync.Mutex
+	stopped     bool
+	interrupted bool
+}
+
+// start starts enforcing the limits on a session over rw, until ctx is
+// cancelled. If rw supports deadlines, the deadline of the session is
+// set on it, and it is moved to now once ctx is cancelled, so that
+// blocked reads and writes fail.
+func (l Limits) start(ctx context.Context, rw io.ReadWriter, conn *Conn) (*limiter, error) {
+	lim := &limiter{Limits: l, ctx: ctx, rw: rw}
+	if l.MaxMessageSize != 0 {
+		conn.SetMaxMessageSize(l.MaxMessageSize)
+	}
+
+	d, ok := rw.(deadliner)
+	if l.Timeout > 0 {
+		lim.deadline = time.Now().Add(l.Timeout)
+		if ok {
+			if err := d.SetDeadline(lim.deadline); err != nil {
+				return lim, err
+			}
+		}
+	}
+	if ok {
+		lim.stopCancel = context.AfterFunc(ctx, func() {
+			lim.mu.Lock()
+			defer lim.mu.Unlock()
+			if !lim.stopped {
+				lim.interrupted = true
+				d.SetDeadline(time.Now())
+			}
+		})
+	}
+	return lim, nil
+}
+
+// stop clears the deadline set on the stream by start or by the
+// cancellation of the session.
+func (l *limiter) stop() {
+	if l.stopCancel != nil {
+		l.stopCancel()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopped = true
+	if d, ok := l.rw.(deadliner); ok && (!l.deadline.IsZero() || l.interrupted) {
+		d.SetDeadline(time.Time{})
+	}
+}
+
+// expired returns the error of the context once it is cancelled, or
+// ErrDeadline once the deadline has passed.
+func (l *limiter) expired() error {
+	if err := l.ctx.Err(); err != nil {
+		return err
+	}
+	if !l.deadline.IsZero() && time.Now().After(l.deadline) {
+		return ErrDeadline
+	}
+	return nil
+}
+
+// iterations returns ErrIterationLimit once n batches are the most
+// a session may send or receive.
+func (l *limiter) iterations(n uint64) error {
+	if l.MaxIterations != 0 && n >= l.MaxIterations {
+		return fmt.Errorf("%w: %d iterations", ErrIterationLimit, n)
+	}
+	return nil
+}
+
+// cells returns ErrCellLimit if an IBF of n cells is too large.
+func (l *limiter) cells(n uint64) error {
+	if l.MaxCells != 0 && n > l.MaxCells {
+		return fmt.Errorf("%w: %d cells, at most %d", ErrCellLimit, n, l.MaxCells)
+	}
+	return nil
+}
+
+// symbols returns the first MaxDecodedSymbols symbols of a difference,
+// and ErrSymbolLimit if the difference has more.
+func (l *limiter) symbols(a, b []*uint256.Int) ([]*uint256.Int, []*uint256.Int, error) {
+	n := len(a) + len(b)
+	if l.MaxDecodedSymbols == 0 || n <= l.MaxDecodedSymbols {
+		return a, b, nil
+	}
+	err := fmt.Errorf("%w: %d symbols, at most %d", ErrSymbolLimit, n, l.MaxDecodedSymbols)
+	if len(a) >= l.MaxDecodedSymbols {
+		return a[:l.MaxDecodedSymbols], nil, err
+	}
+	return a, b[:l.MaxDecodedSymbols-len(a)], err
+}
+
+// err returns err, wrapped in the error of the context if it was
+// cancelled, or in ErrDeadline if the stream failed on the deadline of
+// the session.
+func (l *limiter) err(err error) error {
+	if ctxErr := l.ctx.Err(); err != nil && ctxErr != nil {
+		if errors.Is(err, ctxErr) {
+			return err
+		}
+		return fmt.Errorf("%w: %w", ctxErr, err)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, ErrDeadline) {
+		return fmt.Errorf("%w: %w", ErrDeadline, err)
+	}
+	return err
+}
+
+// incompleteErr returns ErrIncomplete after n iterations, wrapping the
+// reason the difference was not decoded if there is one.
+func incompleteErr(n uint64, reason error) error {
+	if reason == nil {
+		return fmt.Errorf("%w after %d iterations", ErrIncomplete, n)
+	}
+	return fmt.Errorf("%w after %d iterations: %w", ErrIncomplete, n, reason)
+}
@@ -0,0 +1,462 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/holiman/uint256"
+	"github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+// Message types, the first byte of every message.
+const (
+	helloMessage     byte = 1
+	cellBatchMessage byte = 2
+	stopMessage      byte = 3
+	diffListMessage  byte = 4
+	acceptMessage    byte = 5
+	rejectMessage    byte = 6
+)
+
+// maxMessageSize bounds the payload of a message read from the wire,
+// unless a Conn sets another limit.
+const maxMessageSize = 64 << 20
+
+// maxNameLen bounds names and parameter blobs in messages.
+const maxNameLen = 1 << 10
+
+// Message errors
+var (
+	ErrUnknownMessage    = errors.New("unknown message type")
+	ErrUnexpectedMessage = errors.New("unexpected message")
+	ErrMalformedMessage  = errors.New("malformed message")
+	ErrMessageTooLarge   = errors.New("message too large")
+)
+
+// Message is one of Hello, Accept, Reject, CellBatch, Stop and DiffList.
+type Message interface {
+	messageType() byte
+}
+
+// Hello opens a session with the protocol version of the sender and
+// the parameters of its IBF.
+type Hello struct {
+	Version uint8
+	Params  Params
+}
+
+// Accept accepts the parameters of the last Hello, with the nonce of
+// the receiver, from which and the sender's seed the session seed is
+// derived.
+type Accept struct {
+	Nonce []byte
+}
+
+// Reject rejects the parameters of the last Hello. The receiver may
+// propose parameters it would accept instead.
+type Reject struct {
+	Reason   string
+	Fallback *Params
+}
+
+// CellBatch carries the cells of one iteration of the sender's IBF.
+type CellBatch struct {
+	certainsync.CellBatch
+}
+
+// Stop tells the peer that no more cell batches will be sent, or
+// asks it to stop sending them.
+type Stop struct{}
+
+// DiffList ends a session with the difference the receiver decoded.
+type DiffList struct {
+	SenderOnly   []*uint256.Int
+	ReceiverOnly []*uint256.Int
+	// Whether the lists hold the whole difference.
+	Complete bool
+}
+
+func (Hello) messageType() byte     { return helloMessage }
+func (Accept) messageType() byte    { return acceptMessage }
+func (Reject) messageType() byte    { return rejectMessage }
+func (CellBatch) messageType() byte { return cellBatchMessage }
+func (Stop) messageType() byte      { return stopMessage }
+func (DiffList) messageType() byte  { return diffListMessage }
+
+// Conn reads and writes session messages over a stream. Each message
+// is its type byte, its payload length as a uvarint and its payload.
+// A Conn may be read from and written to by two goroutines at once.
+type Conn struct {
+	w io.Writer
+	r *bufio.Reader
+
+	// Parameters of the session, set by the Hello sent or received.
+	params *Params
+
+	// Maximum payload size of a message read.
+	maxSize uint64
+
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+}
+
+// NewConn returns a Conn that reads and writes messages over rw.
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{w: rw, r: bufio.NewReader(rw), maxSize: maxMessageSize}
+}
+
+// SetMaxMessageSize sets the maximum payload size of a message read.
+// Larger messages fail with ErrMessageTooLarge.
+func (c *Conn) SetMaxMessageSize(n uint64) {
+	c.maxSize = n
+}
+
+// BytesSent returns the number of bytes of the messages written.
+func (c *Conn) BytesSent() uint64 {
+	return c.bytesSent.Load()
+}
+
+// BytesReceived returns the number of bytes of the messages read.
+func (c *Conn) BytesReceived() uint64 {
+	return c.bytesReceived.Load()
+}
+
+// WriteMessage writes a message. Cell batches can only be written
+// once a Hello has been written or read.
+func (c *Conn) WriteMessage(m Message) error {
+	var payload bytes.Buffer
+	switch m := m.(type) {
+	case Hello:
+		appendHello(&payload, m)
+		c.params = &m.Params
+	case Accept:
+		appendString(&payload, m.Nonce)
+	case Reject:
+		appendReject(&payload, m)
+	case CellBatch:
+		if c.params == nil {
+			return fmt.Errorf("%w: cell batch before hello", ErrUnexpectedMessage)
+		}
+		if err := certainsync.NewEncoder(&payload).EncodeBatch(m.CellBatch, c.params.Layout); err != nil {
+			return err
+		}
+	case Stop:
+	case DiffList:
+		appendDiffList(&payload, m)
+	default:
+		return fmt.Errorf("%w: %T", ErrUnknownMessage, m)
+	}
+
+	frame := make([]byte, 0, 1+binary.MaxVarintLen64+payload.Len())
+	frame = append(frame, m.messageType())
+	frame = binary.AppendUvarint(frame, uint64(payload.Len()))
+	frame = append(frame, payload.Bytes()...)
+
+	if _, err := c.w.Write(frame); err != nil {
+		return err
+	}
+	c.bytesSent.Add(uint64(len(frame)))
+	return nil
+}
+
+// ReadMessage reads the next message. Cell batches are decoded with
+// the parameters of the Hello written or read before them.
+func (c *Conn) ReadMessage() (Message, error) {
+	typ, err := c.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	size, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, readErr(err)
+	}
+	if size > c.maxSize {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d", ErrMessageTooLarge, size, c.maxSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return nil, readErr(err)
+	}
+	c.bytesReceived.Add(1 + uint64(uvarintLen(size)) + size)
+
+	r := bytes.NewReader(payload)
+	var m Message
+	switch typ {
+	case helloMessage:
+		var hello Hello
+		if hello, err = readHello(r); err == nil {
+			c.params = &hello.Params
+		}
+		m = hello
+	case acceptMessage:
+		var accept Accept
+		accept.Nonce, err = readString(r)
+		m = accept
+	case rejectMessage:
+		m, err = readReject(r)
+	case cellBatchMessage:
+		if c.params == nil {
+			return nil, fmt.Errorf("%w: cell batch before hello", ErrUnexpectedMessage)
+		}
+		var batch CellBatch
+		batch.CellBatch, err = certainsync.NewDecoder(r).DecodeBatch(c.params.Layout, c.params.Superset)
+		m = batch
+		if err == nil && size != batchSize(batch.CellBatch, c.params) {
+			return nil, fmt.Errorf("%w: cell batch of %d bytes", ErrMalformedMessage, size)
+		}
+		// The decoder reads ahead, so it has consumed the payload.
+		r.Reset(nil)
+	case stopMessage:
+		m = Stop{}
+	case diffListMessage:
+		m, err = readDiffList(r)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownMessage, typ)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrMalformedMessage, r.Len())
+	}
+
+	return m, nil
+}
+
+// batchSize returns the size of the payload of a cell batch.
+func batchSize(batch certainsync.CellBatch, p *Params) uint64 {
+	return uint64(uvarintLen(batch.Iteration)+uvarintLen(batch.Offset)+uvarintLen(uint64(len(batch.Cells)))) +
+		(batch.BitsLen(p.Layout)+7)/8
+}
+
+// appendHello writes the protocol version and the parameters of a Hello.
+func appendHello(buf *bytes.Buffer, m Hello) {
+	buf.WriteByte(m.Version)
+	appendParams(buf, m.Params)
+}
+
+// readHello reads a Hello written by appendHello.
+func readHello(r *bytes.Reader) (Hello, error) {
+	var m Hello
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return m, err
+	}
+	m.Version = version
+	m.Params, err = readParams(r)
+	return m, err
+}
+
+// appendReject writes the reason of a Reject, followed by a flag
+// byte and the fallback parameters if there are any.
+func appendReject(buf *bytes.Buffer, m Reject) {
+	appendString(buf, []byte(m.Reason))
+	if m.Fallback == nil {
+		buf.WriteByte(0)
+		return
+	}
+	buf.WriteByte(1)
+	appendParams(buf, *m.Fallback)
+}
+
+// readReject reads a Reject written by appendReject.
+func readReject(r *bytes.Reader) (Reject, error) {
+	var m Reject
+
+	reason, err := readString(r)
+	if err != nil {
+		return m, err
+	}
+	m.Reason = string(reason)
+
+	hasFallback, err := r.ReadByte()
+	if err != nil {
+		return m, err
+	}
+	switch hasFallback {
+	case 0:
+		return m, nil
+	case 1:
+		fallback, err := readParams(r)
+		m.Fallback = &fallback
+		return m, err
+	default:
+		return m, fmt.Errorf("fallback flag %d", hasFallback)
+	}
+}
+
+// appendParams writes session parameters: the universe size, the
+// mapping descriptor, the hasher name, the session seed, the superset
+// flag and the widths of the cell fields.
+func appendParams(buf *bytes.Buffer, p Params) {
+	universe := p.UniverseSize.Bytes32()
+	buf.Write(universe[:])
+	appendString(buf, []byte(p.Mapping.Name))
+	appendString(buf, p.Mapping.Params)
+	appendString(buf, []byte(p.Hasher))
+	appendString(buf, p.Seed)
+	if p.Superset {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	appendUvarint(buf, uint64(p.Layout.CountBits))
+	appendUvarint(buf, uint64(p.Layout.XorSumBits))
+	appendUvarint(buf, uint64(p.Layout.HashSumBits))
+}
+
+// readParams reads parameters written by appendParams.
+func readParams(r *bytes.Reader) (Params, error) {
+	var p Params
+
+	var universe [32]byte
+	if _, err := io.ReadFull(r, universe[:]); err != nil {
+		return p, err
+	}
+	p.UniverseSize = new(uint256.Int).SetBytes32(universe[:])
+
+	mappingName, err := readString(r)
+	if err != nil {
+		return p, err
+	}
+	p.Mapping.Name = string(mappingName)
+	if p.Mapping.Params, err = readString(r); err != nil {
+		return p, err
+	}
+	hasher, err := readString(r)
+	if err != nil {
+		return p, err
+	}
+	p.Hasher = string(hasher)
+	if p.Seed, err = readString(r); err != nil {
+		return p, err
+	}
+	if len(p.Seed) == 0 {
+		p.Seed = nil
+	}
+
+	superset, err := r.ReadByte()
+	if err != nil {
+		return p, err
+	}
+	if superset > 1 {
+		return p, fmt.Errorf("superset flag %d", superset)
+	}
+	p.Superset = superset == 1
+
+	for _, width := range []*uint{&p.Layout.CountBits, &p.Layout.XorSumBits, &p.Layout.HashSumBits} {
+		bits, err := binary.ReadUvarint(r)
+		if err != nil {
+			return p, err
+		}
+		if bits > 256 {
+			return p, fmt.Errorf("field of %d bits", bits)
+		}
+		*width = uint(bits)
+	}
+
+	return p, nil
+}
+
+// appendDiffList writes the completeness flag and the two symbol
+// lists of a DiffList, each as a count followed by the symbols.
+func appendDiffList(buf *bytes.Buffer, m DiffList) {
+	if m.Complete {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	for _, symbols := range [][]*uint256.Int{m.SenderOnly, m.ReceiverOnly} {
+		appendUvarint(buf, uint64(len(symbols)))
+		for _, s := range symbols {
+			appendString(buf, s.Bytes())
+		}
+	}
+}
+
+// readDiffList reads a DiffList written by appendDiffList.
+func readDiffList(r *bytes.Reader) (DiffList, error) {
+	var m DiffList
+
+	complete, err := r.ReadByte()
+	if err != nil {
+		return m, err
+	}
+	if complete > 1 {
+		return m, fmt.Errorf("complete flag %d", complete)
+	}
+	m.Complete = complete == 1
+
+	for _, symbols := range []*[]*uint256.Int{&m.SenderOnly, &m.ReceiverOnly} {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return m, err
+		}
+		// Each symbol takes at least a byte.
+		if n > uint64(r.Len()) {
+			return m, fmt.Errorf("%d symbols in %d bytes", n, r.Len())
+		}
+		*symbols = make([]*uint256.Int, 0, n)
+		for i := uint64(0); i < n; i++ {
+			b, err := readString(r)
+			if err != nil {
+				return m, err
+			}
+			if len(b) > 32 {
+				return m, fmt.Errorf("symbol of %d bytes", len(b))
+			}
+			*symbols = append(*symbols, new(uint256.Int).SetBytes(b))
+		}
+	}
+
+	return m, nil
+}
+
+func appendUvarint(buf *bytes.Buffer, x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], x)])
+}
+
+// appendString writes a uvarint length-prefixed byte string.
+func appendString(buf *bytes.Buffer, s []byte) {
+	appendUvarint(buf, uint64(len(s)))
+	buf.Write(s)
+}
+
+// readString reads a byte string written by appendString.
+func readString(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxNameLen || n > uint64(r.Len()) {
+		return nil, fmt.Errorf("string of %d bytes", n)
+	}
+	s := make([]byte, n)
+	_, err = io.ReadFull(r, s)
+	return s, err
+}
+
+// readErr reports a stream that ended inside a message as malformed.
+func readErr(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// uvarintLen returns the encoded length of x as a uvarint.
+func uvarintLen(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
@@ -0,0 +1,367 @@
+// Package session runs CertainSync set reconciliation between two
+// peers over a stream.
+//
+// The sender opens the session with a Hello holding the protocol
+// version and the parameters of its IBF, with a nonce of the sender as
+// seed. The receiver answers Accept with a nonce of its own, or Reject
+// with the reason and, if it can, fallback parameters that it would
+// accept, such as EGH for a mapping it does not support; the sender
+// then retries once with them. Keyed hashers are keyed from the seed
+// derived from both nonces, so that neither peer picks their key.
+// Once the parameters are agreed on, the sender streams a CellBatch
+// per iteration. The receiver builds
+// the same IBF over its own set and decodes the difference after every
+// batch. Once decoding succeeds it sends Stop; the sender answers with
+// Stop once it has sent its last batch, and the receiver ends the
+// session with a DiffList of the decoded difference. A sender whose
+// mapping runs out of iterations sends Stop on its own, and the
+// receiver then ends the session with an incomplete DiffList.
+//
+// Sessions with untrusted peers should set Limits, as a rateless
+// session otherwise runs until the difference is decoded.
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/holiman/uint256"
+	"github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+// ErrIncomplete is returned when a session ends before the receiver
+// decoded the whole difference.
+var ErrIncomplete = errors.New("session ended before the difference was decoded")
+
+// Result describes the outcome of a session for one peer.
+type Result struct {
+	// Symbols only in the local set.
+	LocalOnly []*uint256.Int
+	// Symbols only in the remote set.
+	RemoteOnly []*uint256.Int
+
+	// Parameters agreed on in the handshake.
+	Params Params
+
+	// Number of cell batches sent or received.
+	Iterations uint64
+
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// Sender streams the cells of its set to a Receiver.
+type Sender struct {
+	// Limits bound the sessions of the sender, none by default.
+	Limits Limits
+
+	symbols      []*uint256.Int
+	universeSize *uint256.Int
+	mapping      certainsync.MappingMethod
+	opts         []certainsync.IBFOption
+}
+
+// NewSender creates a sender for the given set, whose IBF is built
+// with the given universe, mapping method and options, unless the
+// receiver proposes fallback parameters. Keyed hashers are keyed from
+// the nonces both peers send in the handshake of each session.
+func NewSender(symbols []*uint256.Int, universeSize *uint256.Int, mapping certainsync.MappingMethod, opts ...certainsync.IBFOption) *Sender {
+	return &Sender{
+		symbols:      symbols,
+		universeSize: universeSize,
+		mapping:      mapping,
+		opts:         opts,
+	}
+}
+
+// readResult is a message read by the reading goroutine of a Sender.
+type readResult struct {
+	m   Message
+	err error
+}
+
+// Run runs the sender side of a session over rw, until it ends or ctx
+// is cancelled. It reads from rw in a separate goroutine while it
+// writes cell batches, which ends with the session, unless it is
+// blocked reading from rw; the caller should close rw if Run returns
+// an error other than ErrIncomplete to end that read. Blocked reads
+// and writes are only interrupted by cancellation if rw supports
+// deadlines, as a net.Conn does.
+func (s *Sender) Run(ctx context.Context, rw io.ReadWriter) (*Result, error) {
+	conn := NewConn(rw)
+	result := &Result{}
+
+	limits, err := s.Limits.start(ctx, rw, conn)
+	defer limits.stop()
+	if err == nil {
+		err = s.run(conn, limits, result)
+	}
+
+	result.BytesSent, result.BytesReceived = conn.BytesSent(), conn.BytesReceived()
+	return result, limits.err(err)
+}
+
+// run runs a session over conn and fills in result as it goes.
+func (s *Sender) run(conn *Conn, limits *limiter, result *Result) error {
+	params, err := ParamsOf(certainsync.NewIBF(s.universeSize, s.mapping, s.opts...))
+	if err != nil {
+		return err
+	}
+	if params.Seed, err = certainsync.NewSessionSeed(); err != nil {
+		return err
+	}
+	if params, err = s.handshake(conn, params); err != nil {
+		return err
+	}
+	result.Params = params
+
+	mapping, opts, err := params.build()
+	if err != nil {
+		return err
+	}
+	ibf := certainsync.NewIBF(params.UniverseSize, mapping, opts...)
+
+	// The receiver may send Stop at any time, so messages are read
+	// while batches are written. The reader stops once run returns,
+	// after the read it may be blocked in.
+	messages := make(chan readResult, 2)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			m, err := conn.ReadMessage()
+			select {
+			case messages <- readResult{m, err}:
+			case <-done:
+				return
+			}
+			if _, ok := m.(DiffList); ok || err != nil {
+				return
+			}
+		}
+	}()
+
+	// Why the sender stopped sending batches, if it hit a limit.
+	var limitErr error
+	stopped := false
+	for !stopped {
+		select {
+		case r := <-messages:
+			if err := expect[Stop](r); err != nil {
+				return err
+			}
+			stopped = true
+			continue
+		default:
+		}
+
+		if err := limits.expired(); err != nil {
+			return err
+		}
+		if limitErr = limits.iterations(result.Iterations); limitErr != nil {
+			break
+		}
+
+		// The IBF is checked before it grows, as a single iteration of
+		// some mappings adds millions of cells.
+		if limitErr = limits.cells(ibf.Size + mapping.GetAdditionalCellsCount(ibf.Iteration+1)); limitErr != nil {
+			break
+		}
+		batch, err := ibf.AddSymbols(s.symbols)
+		if errors.Is(err, certainsync.ErrIterationsExhausted) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := conn.WriteMessage(CellBatch{batch}); err != nil {
+			return err
+		}
+		result.Iterations++
+	}
+
+	if err := conn.WriteMessage(Stop{}); err != nil {
+		return err
+	}
+	if !stopped {
+		if err := expect[Stop](<-messages); err != nil {
+			return err
+		}
+	}
+
+	r := <-messages
+	if err := expect[DiffList](r); err != nil {
+		return err
+	}
+	diff := r.m.(DiffList)
+
+	var symbolErr error
+	result.LocalOnly, result.RemoteOnly, symbolErr = limits.symbols(diff.SenderOnly, diff.ReceiverOnly)
+	if symbolErr != nil {
+		return incompleteErr(result.Iterations, symbolErr)
+	}
+	if !diff.Complete {
+		return incompleteErr(result.Iterations, limitErr)
+	}
+	return nil
+}
+
+// expect returns the read error of r, or ErrUnexpectedMessage if
+// the message read is not an M.
+func expect[M Message](r readResult) error {
+	if r.err != nil {
+		return r.err
+	}
+	if _, ok := r.m.(M); !ok {
+		var want M
+		return fmt.Errorf("%w: got %T, want %T", ErrUnexpectedMessage, r.m, want)
+	}
+	return nil
+}
+
+// Receiver decodes the difference between its set and the set of a
+// Sender from the cells the sender streams.
+type Receiver struct {
+	// Limits bound the sessions of the receiver, none by default.
+	Limits Limits
+
+	symbols []*uint256.Int
+
+	// Names of the accepted mappings and hashers, nil for all.
+	mappings []string
+	hashers  []string
+}
+
+// NewReceiver creates a receiver for the given set.
+func NewReceiver(symbols []*uint256.Int, opts ...ReceiverOption) *Receiver {
+	r := &Receiver{symbols: symbols}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Run runs the receiver side of a session over rw, until it ends or
+// ctx is cancelled, in which case the Result holds what was decoded so
+// far. The IBF of the receiver's set is built with the parameters
+// agreed on with the sender.
+func (r *Receiver) Run(ctx context.Context, rw io.ReadWriter) (*Result, error) {
+	conn := NewConn(rw)
+	result := &Result{}
+
+	limits, err := r.Limits.start(ctx, rw, conn)
+	defer limits.stop()
+	if err == nil {
+		err = r.run(conn, limits, result)
+	}
+
+	result.BytesSent, result.BytesReceived = conn.BytesSent(), conn.BytesReceived()
+	return result, limits.err(err)
+}
+
+// run runs a session over conn and fills in result as it goes, so
+// that it holds what was decoded if the session fails.
+func (r *Receiver) run(conn *Conn, limits *limiter, result *Result) error {
+	params, err := r.handshake(conn)
+	result.Params = params
+	if err != nil {
+		return err
+	}
+
+	mapping, opts, err := params.build()
+	if err != nil {
+		return err
+	}
+	ibf := certainsync.NewIBF(params.UniverseSize, mapping, opts...)
+	decoder := certainsync.NewIncrementalDecoder(params.UniverseSize, mapping, opts...)
+
+	decodeErr := errors.New("no cell batch received")
+	// Why the receiver stopped the session, if it hit a limit.
+	var limitErr error
+	stopped := false
+
+	stop := func() error {
+		stopped = true
+		return conn.WriteMessage(Stop{})
+	}
+
+	for {
+		if err := limits.expired(); err != nil {
+			return err
+		}
+		m, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		switch m := m.(type) {
+		case CellBatch:
+			// Batches sent before the sender saw our Stop are dropped.
+			if stopped {
+				continue
+			}
+			// So are batches that would grow the IBF past the limit. The
+			// growth is the mapping's, whatever the sender claims.
+			if limitErr = limits.cells(ibf.Size + mapping.GetAdditionalCellsCount(ibf.Iteration+1)); limitErr != nil {
+				if err := stop(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			local, err := ibf.AddSymbols(r.symbols)
+			if err != nil {
+				return err
+			}
+			// In superset mode the sender holds the larger set, so the
+			// receiver's cells are subtracted from the sender's.
+			if err := decoder.AddBatches(m.CellBatch, local); err != nil {
+				return err
+			}
+			result.Iterations++
+
+			var decoded *certainsync.DecodeResult
+			decoded, decodeErr = decoder.Decode()
+			result.LocalOnly, result.RemoteOnly, limitErr = limits.symbols(decoded.AWithoutB, decoded.BWithoutA)
+			if limitErr == nil && decodeErr != nil {
+				limitErr = limits.iterations(result.Iterations)
+			}
+
+			// More cells cannot undo a superset violation.
+			if decodeErr == nil || errors.Is(decodeErr, certainsync.ErrSupersetViolation) || limitErr != nil {
+				if err := stop(); err != nil {
+					return err
+				}
+			}
+
+		case Stop:
+			if !stopped {
+				if err := stop(); err != nil {
+					return err
+				}
+			}
+
+			reason := limitErr
+			if reason == nil {
+				reason = decodeErr
+			}
+			diff := DiffList{
+				SenderOnly:   result.RemoteOnly,
+				ReceiverOnly: result.LocalOnly,
+				Complete:     reason == nil,
+			}
+			if err := conn.WriteMessage(diff); err != nil {
+				return err
+			}
+			if reason != nil {
+				return incompleteErr(result.Iterations, reason)
+			}
+			return nil
+
+		default:
+			return fmt.Errorf("%w: got %T", ErrUnexpectedMessage, m)
+		}
+	}
+}
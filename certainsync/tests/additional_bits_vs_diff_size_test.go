@@ -45,7 +45,7 @@ func BenchmarkAdditionalBitsVsDiffSize(b *testing.B) {
 	numTrials := 10
 	universeSize := int(math.Pow(10, 6))
 
-	mappingTypes := []MappingType{EGH, OLS}
+	mappingTypes := []MappingType{EGH, OLS, ExtendedHamming}
 
 	for _, mappingType := range mappingTypes {
 		filename := fmt.Sprintf("%s_additional_bits_vs_diff_size_set_inside_set.csv", string(mappingType))
@@ -70,6 +70,8 @@ func BenchmarkAdditionalBitsVsDiffSize(b *testing.B) {
 		var maxSymmetricDiffSize int
 		if mappingType == OLS {
 			maxSymmetricDiffSize = int(math.Ceil(math.Sqrt(float64(universeSize))))
+		} else if mappingType == ExtendedHamming {
+			maxSymmetricDiffSize = extendedHammingMaxDiffSize
 		} else {
 			maxSymmetricDiffSize = benches[len(benches)-1].symmetricDiffSize
 		}
@@ -91,8 +93,8 @@ func BenchmarkAdditionalBitsVsDiffSize(b *testing.B) {
 			b.Run(fmt.Sprintf("%s_Universe=%d_Diff=%d",
 				mappingType, universeSize, bench.symmetricDiffSize),
 				func(b *testing.B) {
-					results := make(chan uint64, numTrials)
-					var totalBitsTransmitted uint64
+					bits := make([]uint64, numTrials)
+					decoded := make([]bool, numTrials)
 
 					var wg sync.WaitGroup
 					wg.Add(numTrials)
@@ -101,28 +103,27 @@ func BenchmarkAdditionalBitsVsDiffSize(b *testing.B) {
 						go func(trialNum int) {
 							defer wg.Done()
 							rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(trialNum)))
-							result := runTrialTotalBitsVsDiffSize(
+							bits[trialNum], decoded[trialNum] = runTrialTotalBitsVsDiffSize(
 								trialNum+1,
 								universeSize,
 								bench.symmetricDiffSize,
 								mappingType,
 								rng,
 							)
-							results <- result
 						}(i)
 					}
 
-					go func() {
-						wg.Wait()
-						close(results)
-					}()
+					wg.Wait()
 
-					for result := range results {
-						totalBitsTransmitted += result
+					average, failed := averageDecodedBits(bits, decoded)
+					if failed > 0 {
+						log.Printf("%s, Symmetric Difference len %d: %d of %d trials failed\n",
+							mappingType, bench.symmetricDiffSize, failed, numTrials)
 					}
-
-					avgFloatBitsTransmitted := float64(totalBitsTransmitted) / float64(numTrials)
-					avgBitsTransmitted := int(math.Ceil(avgFloatBitsTransmitted))
+					if failed == numTrials {
+						return
+					}
+					avgBitsTransmitted := int(average)
 					avgAdditionalBitsTransmitted := int(math.Ceil(float64(avgBitsTransmitted-prevAvgBitsTransmitted) / float64(bench.symmetricDiffSize-prevSymmtericDiffSize)))
 
 					prevSymmtericDiffSize = bench.symmetricDiffSize
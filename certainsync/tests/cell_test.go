@@ -0,0 +1,104 @@
+package certainsync_test
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/holiman/uint256"
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+// cellBenchIterations gives EGH IBFs about 10^5 cells.
+const cellBenchIterations = 200
+
+// reportGC reports the GC cycles and stop-the-world pause time per
+// op from the call to the returned function, which the benchmark
+// calls once its loop is done.
+func reportGC(b *testing.B) func() {
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	return func() {
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gc/op")
+		b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+	}
+}
+
+// cellBenchIBF returns an EGH IBF of the symbols 1..n over the
+// 10^6 universe with cellBenchIterations iterations.
+func cellBenchIBF(n uint64) *InvertibleBloomFilter {
+	ibf := NewIBF(uint256.NewInt(1000000), &EGHMapping{})
+	symbols := symbolRange(1, n)
+	for i := 0; i < cellBenchIterations; i++ {
+		ibf.AddSymbols(symbols)
+	}
+	return ibf
+}
+
+func BenchmarkAddSymbols(b *testing.B) {
+	for _, n := range []uint64{100, 1000} {
+		symbols := symbolRange(1, n)
+		cells := cellBenchIBF(n).Size
+
+		b.Run(fmt.Sprintf("Symbols=%d_Cells=%d", n, cells), func(b *testing.B) {
+			b.ReportAllocs()
+			done := reportGC(b)
+			for i := 0; i < b.N; i++ {
+				ibf := NewIBF(uint256.NewInt(1000000), &EGHMapping{})
+				for j := 0; j < cellBenchIterations; j++ {
+					ibf.AddSymbols(symbols)
+				}
+			}
+			done()
+		})
+	}
+}
+
+func BenchmarkSubtract(b *testing.B) {
+	ibfA := cellBenchIBF(1000)
+	ibfB := cellBenchIBF(1010)
+
+	b.Run(fmt.Sprintf("Cells=%d", ibfA.Size), func(b *testing.B) {
+		b.ReportAllocs()
+		done := reportGC(b)
+		for i := 0; i < b.N; i++ {
+			ibfB.Subtract(ibfA)
+		}
+		done()
+	})
+
+	// Subtracting A back and forth leaves B unchanged.
+	b.Run(fmt.Sprintf("InPlace_Cells=%d", ibfA.Size), func(b *testing.B) {
+		b.ReportAllocs()
+		done := reportGC(b)
+		for i := 0; i < b.N; i++ {
+			if err := ibfB.SubtractInPlace(ibfA); err != nil {
+				b.Fatal(err)
+			}
+			if err := ibfB.Add(ibfA); err != nil {
+				b.Fatal(err)
+			}
+		}
+		done()
+	})
+}
+
+func BenchmarkSubtractDecode(b *testing.B) {
+	ibfA := cellBenchIBF(1000)
+	ibfB := cellBenchIBF(1010)
+
+	b.Run(fmt.Sprintf("Cells=%d", ibfA.Size), func(b *testing.B) {
+		b.ReportAllocs()
+		done := reportGC(b)
+		for i := 0; i < b.N; i++ {
+			if _, _, ok := ibfB.Subtract(ibfA).Decode(); !ok {
+				b.Fatal("decoding failed")
+			}
+		}
+		done()
+	})
+}
@@ -0,0 +1,81 @@
+package certainsync_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/holiman/uint256"
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+// decodableDifference returns the difference IBF of two sets over a
+// universe of universeSize symbols that differ in diffSize symbols,
+// with just enough iterations to decode. The cells of a difference
+// only depend on the differing symbols, so the shared symbols are
+// left out.
+func decodableDifference(universeSize, diffSize int, mapping MappingMethod, rng *rand.Rand) *InvertibleBloomFilter {
+	perm := rng.Perm(universeSize)
+	onlyA := make([]*uint256.Int, 0, diffSize/2)
+	onlyB := make([]*uint256.Int, 0, diffSize-diffSize/2)
+	for i, idx := range perm[:diffSize] {
+		if i < diffSize/2 {
+			onlyA = append(onlyA, uint256.NewInt(uint64(idx+1)))
+		} else {
+			onlyB = append(onlyB, uint256.NewInt(uint64(idx+1)))
+		}
+	}
+
+	ibfA := NewIBF(uint256.NewInt(uint64(universeSize)), mapping)
+	ibfB := NewIBF(uint256.NewInt(uint64(universeSize)), mapping)
+	for {
+		if _, err := ibfA.AddSymbols(onlyA); err != nil {
+			panic(err)
+		}
+		if _, err := ibfB.AddSymbols(onlyB); err != nil {
+			panic(err)
+		}
+
+		if _, _, ok := ibfB.Subtract(ibfA).Decode(); ok {
+			return ibfB.Subtract(ibfA)
+		}
+	}
+}
+
+// BenchmarkDecode decodes differences of the 10^6-universe sets
+// used by BenchmarkTotalBitsVsUniverseSize.
+func BenchmarkDecode(b *testing.B) {
+	universeSize := int(math.Pow(10, 6))
+	diffSizes := []int{30, 300, 3000}
+
+	mappings := []struct {
+		name    MappingType
+		mapping MappingMethod
+	}{
+		{EGH, &EGHMapping{}},
+		{OLS, &OLSMapping{Order: uint256.NewInt(uint64(math.Ceil(math.Sqrt(float64(universeSize)))))}},
+	}
+
+	for _, m := range mappings {
+		for _, diffSize := range diffSizes {
+			diff := decodableDifference(universeSize, diffSize, m.mapping, rand.New(rand.NewSource(int64(diffSize))))
+
+			b.Run(fmt.Sprintf("MappingType=%s_DiffSize=%d_Cells=%d", m.name, diffSize, diff.Size), func(b *testing.B) {
+				ibf := NewIBF(diff.UniverseSize, diff.MappingMethod)
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				for n := 0; n < b.N; n++ {
+					b.StopTimer()
+					ibf.Copy(diff)
+					b.StartTimer()
+
+					if _, _, ok := ibf.Decode(); !ok {
+						b.Fatal("decoding failed")
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package certainsync_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/holiman/uint256"
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+func TestBlake2bHashIsKeyed(t *testing.T) {
+	seed, err := NewSessionSeed()
+	if err != nil {
+		t.Fatalf("NewSessionSeed: %v", err)
+	}
+	otherSeed, err := NewSessionSeed()
+	if err != nil {
+		t.Fatalf("NewSessionSeed: %v", err)
+	}
+
+	data := uint256.NewInt(42).Bytes()
+	h := NewBlake2bHash(seed)
+
+	if !h.Hash(data).Eq(NewBlake2bHash(seed).Hash(data)) {
+		t.Fatalf("same seed gives different hashes")
+	}
+	if h.Hash(data).Eq(NewBlake2bHash(otherSeed).Hash(data)) {
+		t.Fatalf("different seeds give the same hash")
+	}
+	if h.Hash(data).Eq(Sha256Hash{}.Hash(data)) {
+		t.Fatalf("keyed hash matches the unkeyed SHA-256")
+	}
+}
+
+func TestBlake2bHashSession(t *testing.T) {
+	seed, err := NewSessionSeed()
+	if err != nil {
+		t.Fatalf("NewSessionSeed: %v", err)
+	}
+
+	universeSize := uint256.NewInt(1000)
+	mapping := &EGHMapping{}
+	hasher := WithHasher(NewBlake2bHash(seed))
+
+	ibfAlice := NewIBF(universeSize, mapping, hasher)
+	ibfBob := NewIBF(universeSize, mapping, hasher)
+
+	for i := 0; i < 8; i++ {
+		ibfAlice.AddSymbols(symbolRange(1, 500))
+		ibfBob.AddSymbols(symbolRange(3, 502))
+	}
+
+	data, err := ibfAlice.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	// The key is not on the wire.
+	var unkeyed InvertibleBloomFilter
+	if err := unkeyed.UnmarshalBinary(data); !errors.Is(err, ErrMissingHasherKey) {
+		t.Fatalf("got %v, want ErrMissingHasherKey", err)
+	}
+
+	received := NewIBF(universeSize, mapping, hasher)
+	if err := received.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+
+	diff, err := ibfBob.SubtractChecked(received)
+	if err != nil {
+		t.Fatalf("SubtractChecked: %v", err)
+	}
+	bobWithoutAlice, aliceWithoutBob, err := diff.DecodeChecked()
+	if err != nil || len(bobWithoutAlice) != 2 || len(aliceWithoutBob) != 2 {
+		t.Fatalf("decoded %d/%d symbols (err=%v), want 2/2", len(bobWithoutAlice), len(aliceWithoutBob), err)
+	}
+
+	// A peer with another seed cannot take part in the session.
+	otherSeed, _ := NewSessionSeed()
+	other := NewIBF(universeSize, mapping, WithHasher(NewBlake2bHash(otherSeed)))
+	for i := 0; i < 8; i++ {
+		other.AddSymbols(symbolRange(1, 500))
+	}
+	if _, err := ibfBob.SubtractChecked(other); !errors.Is(err, ErrHasherMismatch) {
+		t.Fatalf("got %v, want ErrHasherMismatch", err)
+	}
+}
+
+func TestNewHasher(t *testing.T) {
+	seed, err := NewSessionSeed()
+	if err != nil {
+		t.Fatalf("NewSessionSeed: %v", err)
+	}
+
+	for _, name := range Hashers() {
+		h, err := NewHasher(name, seed)
+		if err != nil {
+			t.Fatalf("NewHasher(%q): %v", name, err)
+		}
+		if h.Name() != name {
+			t.Fatalf("NewHasher(%q) returned hasher %q", name, h.Name())
+		}
+
+		limit := new(uint256.Int).Lsh(uint256.NewInt(1), h.Bits())
+		for i := uint64(1); i <= 100; i++ {
+			hash := h.Hash(uint256.NewInt(i).Bytes())
+			if h.Bits() < 256 && !hash.Lt(limit) {
+				t.Fatalf("%s hash %s is wider than %d bits", name, hash.Hex(), h.Bits())
+			}
+		}
+	}
+
+	if _, err := NewHasher("md5", nil); !errors.Is(err, ErrUnknownHasher) {
+		t.Fatalf("got %v, want ErrUnknownHasher", err)
+	}
+	if _, err := NewHasher(Blake2bHasherName, nil); !errors.Is(err, ErrMissingHasherKey) {
+		t.Fatalf("got %v, want ErrMissingHasherKey", err)
+	}
+}
+
+func TestRegisterHasherPanics(t *testing.T) {
+	assertPanics := func(name string, register func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("%s did not panic", name)
+			}
+		}()
+		register()
+	}
+
+	assertPanics("duplicate name", func() {
+		RegisterHasher(Murmur3HasherName, func() CellHasher { return Murmur3Hash{} })
+	})
+	assertPanics("mismatched name", func() {
+		RegisterHasher("murmur3", func() CellHasher { return Murmur3Hash{} })
+	})
+}
+
+func TestHashersRoundTrip(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+	mapping := &EGHMapping{}
+
+	for _, name := range []string{Murmur3HasherName, Sha256_64HasherName, Sha256_128HasherName} {
+		h, err := NewHasher(name, nil)
+		if err != nil {
+			t.Fatalf("NewHasher(%q): %v", name, err)
+		}
+
+		ibfAlice := NewIBF(universeSize, mapping, WithHasher(h))
+		ibfBob := NewIBF(universeSize, mapping, WithHasher(h))
+		for i := 0; i < 8; i++ {
+			ibfAlice.AddSymbols(symbolRange(1, 500))
+			ibfBob.AddSymbols(symbolRange(3, 502))
+		}
+
+		data, err := ibfAlice.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %v", err)
+		}
+
+		// The receiver learns the hasher from the header.
+		var received InvertibleBloomFilter
+		if err := received.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary: %v", err)
+		}
+		if received.Hasher.Name() != name {
+			t.Fatalf("decoded hasher %q, want %q", received.Hasher.Name(), name)
+		}
+		if received.Layout.HashSumBits != h.Bits() {
+			t.Fatalf("decoded %d HashSum bits, want %d", received.Layout.HashSumBits, h.Bits())
+		}
+
+		diff, err := ibfBob.SubtractChecked(&received)
+		if err != nil {
+			t.Fatalf("SubtractChecked: %v", err)
+		}
+		bobWithoutAlice, aliceWithoutBob, err := diff.DecodeChecked()
+		if err != nil || len(bobWithoutAlice) != 2 || len(aliceWithoutBob) != 2 {
+			t.Fatalf("%s: decoded %d/%d symbols (err=%v), want 2/2",
+				name, len(bobWithoutAlice), len(aliceWithoutBob), err)
+		}
+	}
+}
+
+// BenchmarkHashers measures the speed of the registered hashers, and
+// their false-purity rate once truncated to falsePurityBits bits: the
+// rate at which a cell holding two symbols passes the purity check.
+func BenchmarkHashers(b *testing.B) {
+	const falsePurityBits = 10
+	const trials = 1 << 16
+
+	seed, err := NewSessionSeed()
+	if err != nil {
+		b.Fatalf("NewSessionSeed: %v", err)
+	}
+
+	for _, name := range Hashers() {
+		h, err := NewHasher(name, seed)
+		if err != nil {
+			b.Fatalf("NewHasher(%q): %v", name, err)
+		}
+
+		b.Run(fmt.Sprintf("Hasher=%s", name), func(b *testing.B) {
+			truncated := TruncateHasher(h, falsePurityBits)
+			falsePurities := 0
+			for i := uint64(0); i < trials; i++ {
+				// Count -1 + 2 = 1, as in a cell of a difference
+				// holding two symbols of one set and one of the other.
+				var cell, other IBFCell
+				cell.Insert(uint256.NewInt(3*i+1), truncated)
+				cell.Insert(uint256.NewInt(3*i+2), truncated)
+				other.Insert(uint256.NewInt(3*i+3), truncated)
+				cell.Subtract(&other)
+				if cell.IsPure(truncated) {
+					falsePurities++
+				}
+			}
+
+			data := uint256.NewInt(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				data.SetUint64(uint64(i))
+				h.Hash(data.Bytes())
+			}
+			b.ReportMetric(float64(falsePurities)/trials, "false-pure/cell")
+		})
+	}
+}
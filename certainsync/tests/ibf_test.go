@@ -0,0 +1,382 @@
+package certainsync_test
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/holiman/uint256"
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+func TestApplyBatchMirrorsIBF(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+	mapping := &EGHMapping{}
+
+	local := NewIBF(universeSize, mapping)
+	remote := NewIBF(universeSize, mapping)
+
+	var batchBits uint64
+	for i := 0; i < 5; i++ {
+		batch, err := local.AddSymbols(symbolRange(1, 200))
+		if err != nil {
+			t.Fatalf("AddSymbols: %v", err)
+		}
+
+		if batch.Iteration != local.Iteration {
+			t.Fatalf("got batch iteration %d, want %d", batch.Iteration, local.Iteration)
+		}
+		if batch.Offset+uint64(len(batch.Cells)) != local.Size {
+			t.Fatalf("batch [%d, %d) does not end at IBF size %d",
+				batch.Offset, batch.Offset+uint64(len(batch.Cells)), local.Size)
+		}
+
+		if err := remote.ApplyBatch(batch); err != nil {
+			t.Fatalf("ApplyBatch: %v", err)
+		}
+		batchBits += batch.BitsLen(local.Layout)
+	}
+
+	assertSameIBF(t, local, remote)
+
+	if batchBits != local.GetTransmittedBitsSize() {
+		t.Fatalf("batches account %d bits, IBF %d", batchBits, local.GetTransmittedBitsSize())
+	}
+}
+
+func TestReserveKeepsCellsInPlace(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+
+	ibf := NewIBF(universeSize, &EGHMapping{})
+	ibf.AddSymbols(symbolRange(1, 100))
+	if err := ibf.Reserve(20); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+
+	first := &ibf.Cells[0]
+	for i := 0; i < 20; i++ {
+		ibf.AddSymbols(symbolRange(1, 100))
+	}
+	if &ibf.Cells[0] != first {
+		t.Fatalf("cells moved within the reserved iterations")
+	}
+
+	// Growing past the reservation keeps the cells and batches intact.
+	unreserved := NewIBF(universeSize, &EGHMapping{})
+	var batches []CellBatch
+	for i := 0; i < 30; i++ {
+		batch, _ := unreserved.AddSymbols(symbolRange(1, 100))
+		batches = append(batches, batch)
+	}
+	for _, batch := range batches {
+		for j, cell := range batch.Cells {
+			if cell != unreserved.Cells[batch.Offset+uint64(j)] {
+				t.Fatalf("cell %d of iteration %d differs from its batch", j, batch.Iteration)
+			}
+		}
+	}
+
+	// Reserve stops at the last iteration of bounded mappings.
+	ols := NewIBF(universeSize, &OLSMapping{Order: uint256.NewInt(32)})
+	if err := ols.Reserve(1000); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if got := uint64(cap(ols.Cells)); got < 33*32 {
+		t.Fatalf("reserved %d cells, want %d", got, 33*32)
+	}
+}
+
+func TestTooManyCells(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+	mapping := &SparseMatrixMapping{Blocks: []SparseBlock{{Rows: 2}, {Rows: 1 << 62}}}
+
+	ibf := NewIBF(universeSize, mapping)
+	if _, err := ibf.AddSymbols(symbolRange(1, 10)); err != nil {
+		t.Fatalf("AddSymbols: %v", err)
+	}
+	if err := ibf.Reserve(math.MaxUint64); !errors.Is(err, ErrTooManyCells) {
+		t.Fatalf("Reserve: got %v, want ErrTooManyCells", err)
+	}
+	if _, err := ibf.AddSymbols(symbolRange(1, 10)); !errors.Is(err, ErrTooManyCells) {
+		t.Fatalf("AddSymbols: got %v, want ErrTooManyCells", err)
+	}
+	if ibf.Iteration != 1 || ibf.Size != 2 {
+		t.Fatalf("failed iteration left iteration %d and size %d", ibf.Iteration, ibf.Size)
+	}
+}
+
+func TestApplyBatchRejectsOutOfOrder(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+	mapping := &EGHMapping{}
+
+	local := NewIBF(universeSize, mapping)
+	remote := NewIBF(universeSize, mapping)
+
+	local.AddSymbols(symbolRange(1, 10))
+	second, _ := local.AddSymbols(symbolRange(1, 10))
+
+	if err := remote.ApplyBatch(second); !errors.Is(err, ErrBatchOutOfOrder) {
+		t.Fatalf("got %v, want ErrBatchOutOfOrder", err)
+	}
+
+	truncated := CellBatch{Iteration: 1, Offset: 0, Cells: second.Cells[:1]}
+	if err := remote.ApplyBatch(truncated); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("got %v, want ErrSizeMismatch", err)
+	}
+}
+
+func TestHasherIsPerInstance(t *testing.T) {
+	small := NewIBF(uint256.NewInt(1000), &EGHMapping{})
+	wide := NewIBF(new(uint256.Int).SetAllOne(), &EGHMapping{})
+	custom := NewIBF(uint256.NewInt(1000), &EGHMapping{}, WithHasher(Sha256Hash{}))
+
+	// Interleave the IBFs so a shared hasher would corrupt purity checks.
+	for i := 0; i < 3; i++ {
+		small.AddSymbols(symbolRange(1, 3))
+		wide.AddSymbols(symbolRange(1, 3))
+		custom.AddSymbols(symbolRange(1, 3))
+	}
+
+	if _, ok := small.Hasher.(XXHash64Hash); !ok {
+		t.Fatalf("small universe uses %T, want XXHash64Hash", small.Hasher)
+	}
+	if _, ok := wide.Hasher.(Sha256Hash); !ok {
+		t.Fatalf("wide universe uses %T, want Sha256Hash", wide.Hasher)
+	}
+
+	for _, ibf := range []*InvertibleBloomFilter{small, wide, custom} {
+		bWithoutA, _, ok := ibf.Subtract(newIBFLike(ibf)).Decode()
+		if !ok || len(bWithoutA) != 3 {
+			t.Fatalf("%T IBF decoded %d symbols (ok=%v), want 3", ibf.Hasher, len(bWithoutA), ok)
+		}
+	}
+
+	data, err := custom.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	var decoded InvertibleBloomFilter
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if _, ok := decoded.Hasher.(Sha256Hash); !ok {
+		t.Fatalf("decoded IBF uses %T, want Sha256Hash", decoded.Hasher)
+	}
+	assertSameIBF(t, custom, &decoded)
+}
+
+// newIBFLike returns an empty IBF with the same parameters and
+// number of iterations as ibf.
+func newIBFLike(ibf *InvertibleBloomFilter) *InvertibleBloomFilter {
+	empty := NewIBF(ibf.UniverseSize, ibf.MappingMethod, WithHasher(ibf.Hasher))
+	for i := uint64(0); i < ibf.Iteration; i++ {
+		empty.AddSymbols(nil)
+	}
+	return empty
+}
+
+func TestSubtractCheckedRejectsIncompatible(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+
+	base := NewIBF(universeSize, &EGHMapping{})
+	base.AddSymbols(symbolRange(1, 10))
+
+	moreIterations := NewIBF(universeSize, &EGHMapping{})
+	moreIterations.AddSymbols(nil)
+	moreIterations.AddSymbols(nil)
+
+	otherUniverse := NewIBF(uint256.NewInt(2000), &EGHMapping{})
+	otherUniverse.AddSymbols(nil)
+
+	otherMapping := NewIBF(universeSize, &OLSMapping{Order: uint256.NewInt(2)})
+	otherMapping.AddSymbols(nil)
+
+	otherHasher := NewIBF(universeSize, &EGHMapping{}, WithHasher(Sha256Hash{}))
+	otherHasher.AddSymbols(nil)
+
+	tests := []struct {
+		name  string
+		other *InvertibleBloomFilter
+		want  error
+	}{
+		{"nil", nil, ErrNilIBF},
+		{"iterations", moreIterations, ErrSizeMismatch},
+		{"universe", otherUniverse, ErrUniverseMismatch},
+		{"mapping", otherMapping, ErrMappingMismatch},
+		{"hasher", otherHasher, ErrHasherMismatch},
+	}
+
+	for _, tt := range tests {
+		if _, err := base.SubtractChecked(tt.other); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// Equal mappings need not be the same instance.
+	peer := NewIBF(universeSize, &EGHMapping{})
+	peer.AddSymbols(symbolRange(1, 8))
+	diff, err := base.SubtractChecked(peer)
+	if err != nil {
+		t.Fatalf("SubtractChecked: %v", err)
+	}
+	bWithoutA, aWithoutB, err := diff.DecodeChecked()
+	if err != nil || len(bWithoutA) != 2 || len(aWithoutB) != 0 {
+		t.Fatalf("decoded %d/%d symbols (err=%v), want 2/0", len(bWithoutA), len(aWithoutB), err)
+	}
+}
+
+func TestSubtractInPlaceAndAdd(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+	mapping := &EGHMapping{}
+
+	ibfA := NewIBF(universeSize, mapping)
+	ibfB := NewIBF(universeSize, mapping)
+	union := NewIBF(universeSize, mapping)
+	for i := 0; i < 6; i++ {
+		ibfA.AddSymbols(symbolRange(1, 300))
+		ibfB.AddSymbols(symbolRange(5, 304))
+		union.AddSymbols(append(symbolRange(1, 300), symbolRange(5, 304)...))
+	}
+
+	want := ibfB.Subtract(ibfA)
+
+	inPlace := NewIBF(universeSize, mapping)
+	inPlace.Copy(ibfB)
+	if err := inPlace.SubtractInPlace(ibfA); err != nil {
+		t.Fatalf("SubtractInPlace: %v", err)
+	}
+	assertSameIBF(t, want, inPlace)
+
+	// Adding A back gives B, and A + B is the IBF of the multiset union.
+	if err := inPlace.Add(ibfA); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	assertSameIBF(t, ibfB, inPlace)
+
+	if err := inPlace.Add(ibfA); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	assertSameIBF(t, union, inPlace)
+
+	if err := inPlace.Add(NewIBF(universeSize, mapping)); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("got %v, want ErrSizeMismatch", err)
+	}
+}
+
+func TestSubtractRangeByIteration(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+	mapping := &EGHMapping{}
+
+	ibfA := NewIBF(universeSize, mapping)
+	ibfB := NewIBF(universeSize, mapping)
+	diff := NewIBF(universeSize, mapping)
+
+	for i := 0; i < 6; i++ {
+		ibfA.AddSymbols(symbolRange(1, 300))
+		batch, _ := ibfB.AddSymbols(symbolRange(5, 304))
+
+		// Only the cells of the new iteration are subtracted.
+		if err := diff.ApplyBatch(batch); err != nil {
+			t.Fatalf("ApplyBatch: %v", err)
+		}
+		end := batch.Offset + uint64(len(batch.Cells))
+		if err := diff.SubtractRange(ibfA, batch.Offset, end); err != nil {
+			t.Fatalf("SubtractRange: %v", err)
+		}
+	}
+	assertSameIBF(t, ibfB.Subtract(ibfA), diff)
+
+	if err := diff.SubtractRange(ibfA, 0, diff.Size+1); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("got %v, want ErrSizeMismatch", err)
+	}
+	other := NewIBF(uint256.NewInt(2000), mapping)
+	other.AddSymbols(nil)
+	if err := diff.SubtractRange(other, 0, 1); !errors.Is(err, ErrUniverseMismatch) {
+		t.Fatalf("got %v, want ErrUniverseMismatch", err)
+	}
+}
+
+func TestDecodeCheckedReportsFailure(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+
+	// A single EGH iteration maps 1 and 3 to the same cell of prime 2,
+	// and 2 and 4 to the other one.
+	crowded := NewIBF(universeSize, &EGHMapping{})
+	crowded.AddSymbols(symbolRange(1, 4))
+	if _, _, err := crowded.DecodeChecked(); !errors.Is(err, ErrNoPureCells) {
+		t.Fatalf("got %v, want ErrNoPureCells", err)
+	}
+
+	// With primes 2 and 3, 4 and then 3 peel, but 1 and 7 share
+	// both of their cells.
+	tangled := []*uint256.Int{uint256.NewInt(1), uint256.NewInt(3), uint256.NewInt(4), uint256.NewInt(7)}
+	partial := NewIBF(universeSize, &EGHMapping{})
+	partial.AddSymbols(tangled)
+	partial.AddSymbols(tangled)
+	bWithoutA, _, err := partial.DecodeChecked()
+	if !errors.Is(err, ErrResidualCells) {
+		t.Fatalf("got %v, want ErrResidualCells", err)
+	}
+	if len(bWithoutA) != 2 {
+		t.Fatalf("recovered %d symbols before ErrResidualCells, want 2", len(bWithoutA))
+	}
+
+	outside := NewIBF(universeSize, &EGHMapping{})
+	outside.AddSymbols([]*uint256.Int{uint256.NewInt(1001)})
+	if _, _, err := outside.DecodeChecked(); !errors.Is(err, ErrSymbolOutOfUniverse) {
+		t.Fatalf("got %v, want ErrSymbolOutOfUniverse", err)
+	}
+	if _, _, ok := outside.Decode(); ok {
+		t.Fatalf("Decode succeeded on a symbol out of universe")
+	}
+}
+
+func TestDecodeDetailedDiagnostics(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+
+	tangled := []*uint256.Int{uint256.NewInt(1), uint256.NewInt(3), uint256.NewInt(4), uint256.NewInt(7)}
+	ibf := NewIBF(universeSize, &EGHMapping{})
+	ibf.AddSymbols(tangled)
+	ibf.AddSymbols(tangled)
+
+	result, err := ibf.DecodeDetailed()
+	if !errors.Is(err, ErrResidualCells) {
+		t.Fatalf("got %v, want ErrResidualCells", err)
+	}
+	if result.PeelingSteps != 2 || len(result.BWithoutA) != 2 {
+		t.Fatalf("peeled %d steps recovering %d symbols, want 2 and 2",
+			result.PeelingSteps, len(result.BWithoutA))
+	}
+
+	// 1 and 7 are left in one cell of each iteration.
+	wantResidual := []uint64{1, 1}
+	for i, want := range wantResidual {
+		if result.ResidualCells[i] != want {
+			t.Fatalf("iteration %d has %d residual cells, want %d", i+1, result.ResidualCells[i], want)
+		}
+	}
+	if len(result.UndecodableIterations) != 2 ||
+		result.UndecodableIterations[0] != 1 || result.UndecodableIterations[1] != 2 {
+		t.Fatalf("got undecodable iterations %v, want [1 2]", result.UndecodableIterations)
+	}
+}
+
+func TestDecodeDetailedDetectsFalsePurity(t *testing.T) {
+	ibf := NewIBF(uint256.NewInt(1000), &EGHMapping{})
+	ibf.AddSymbols(nil)
+
+	// 3 maps to cell 1 of the first EGH iteration, so a cell 0 holding
+	// only 3 passes the hash check without being pure.
+	ibf.Cells[0].Insert(uint256.NewInt(3), ibf.Hasher)
+
+	result, err := ibf.DecodeDetailed()
+	if !errors.Is(err, ErrNoPureCells) {
+		t.Fatalf("got %v, want ErrNoPureCells", err)
+	}
+	if result.FalsePurities != 1 {
+		t.Fatalf("got %d false purities, want 1", result.FalsePurities)
+	}
+	if len(result.UndecodableIterations) != 1 || result.UndecodableIterations[0] != 1 {
+		t.Fatalf("got undecodable iterations %v, want [1]", result.UndecodableIterations)
+	}
+}
@@ -0,0 +1,140 @@
+package certainsync_test
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/holiman/uint256"
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+// randomSets returns two sets over 1..universeSize sharing all but
+// onlyA and onlyB symbols.
+func randomSets(rng *rand.Rand, universeSize, shared, onlyA, onlyB int) (a, b []*uint256.Int) {
+	perm := rng.Perm(universeSize)
+	for _, idx := range perm[:shared+onlyA] {
+		a = append(a, uint256.NewInt(uint64(idx+1)))
+	}
+	b = append(b, a[:shared]...)
+	for _, idx := range perm[shared+onlyA : shared+onlyA+onlyB] {
+		b = append(b, uint256.NewInt(uint64(idx+1)))
+	}
+	return a, b
+}
+
+func TestIncrementalDecoderMatchesDecode(t *testing.T) {
+	universeSize := 10000
+	mappings := []MappingMethod{
+		&EGHMapping{},
+		&OLSMapping{Order: uint256.NewInt(100)},
+	}
+
+	rng := rand.New(rand.NewSource(1))
+
+	for _, mapping := range mappings {
+		a, b := randomSets(rng, universeSize, 500, 12, 7)
+
+		ibfA := NewIBF(uint256.NewInt(uint64(universeSize)), mapping)
+		ibfB := NewIBF(uint256.NewInt(uint64(universeSize)), mapping)
+		decoder := NewIncrementalDecoder(uint256.NewInt(uint64(universeSize)), mapping)
+
+		for {
+			batchA, err := ibfA.AddSymbols(a)
+			if err != nil {
+				t.Fatalf("%T: AddSymbols: %v", mapping, err)
+			}
+			batchB, _ := ibfB.AddSymbols(b)
+
+			if err := decoder.AddBatches(batchB, batchA); err != nil {
+				t.Fatalf("%T: AddBatches: %v", mapping, err)
+			}
+			got, gotErr := decoder.Decode()
+
+			want, wantErr := ibfB.Subtract(ibfA).DecodeDetailed()
+
+			if (gotErr == nil) != (wantErr == nil) {
+				t.Fatalf("%T iteration %d: incremental decode got %v, full decode %v",
+					mapping, decoder.Iteration(), gotErr, wantErr)
+			}
+			if wantErr != nil {
+				continue
+			}
+
+			if len(got.BWithoutA) != 7 || len(got.AWithoutB) != 12 {
+				t.Fatalf("%T: recovered %d/%d symbols, want 7/12",
+					mapping, len(got.BWithoutA), len(got.AWithoutB))
+			}
+			if len(got.UndecodableIterations) != 0 || got.PeelingSteps != want.PeelingSteps {
+				t.Fatalf("%T: got %+v, want %+v", mapping, got, want)
+			}
+			break
+		}
+	}
+}
+
+func TestIncrementalDecoderKeepsRecoveredSymbols(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+	mapping := &EGHMapping{}
+
+	ibfA := NewIBF(universeSize, mapping)
+	ibfB := NewIBF(universeSize, mapping)
+	decoder := NewIncrementalDecoder(universeSize, mapping)
+
+	// 1 and 7 stay tangled in the first two iterations, after 3 and 4
+	// are peeled; prime 5 then separates them.
+	tangled := []*uint256.Int{uint256.NewInt(1), uint256.NewInt(3), uint256.NewInt(4), uint256.NewInt(7)}
+	for i := 0; i < 2; i++ {
+		batchA, _ := ibfA.AddSymbols(nil)
+		batchB, _ := ibfB.AddSymbols(tangled)
+		if err := decoder.AddBatches(batchB, batchA); err != nil {
+			t.Fatalf("AddBatches: %v", err)
+		}
+	}
+
+	result, err := decoder.Decode()
+	if !errors.Is(err, ErrResidualCells) || len(result.BWithoutA) != 2 {
+		t.Fatalf("recovered %d symbols (err=%v), want 2 and ErrResidualCells", len(result.BWithoutA), err)
+	}
+
+	batchA, _ := ibfA.AddSymbols(nil)
+	batchB, _ := ibfB.AddSymbols(tangled)
+	if err := decoder.AddBatches(batchB, batchA); err != nil {
+		t.Fatalf("AddBatches: %v", err)
+	}
+
+	next, err := decoder.Decode()
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(next.BWithoutA) != 4 || next.PeelingSteps != 4 {
+		t.Fatalf("recovered %d symbols in %d steps, want 4 and 4", len(next.BWithoutA), next.PeelingSteps)
+	}
+
+	// The earlier result is a snapshot.
+	if len(result.BWithoutA) != 2 || len(result.UndecodableIterations) != 2 {
+		t.Fatalf("earlier result changed to %+v", result)
+	}
+}
+
+func TestIncrementalDecoderRejectsMismatchedBatches(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+	mapping := &EGHMapping{}
+
+	ibfA := NewIBF(universeSize, mapping)
+	ibfB := NewIBF(universeSize, mapping)
+	decoder := NewIncrementalDecoder(universeSize, mapping)
+
+	batchA, _ := ibfA.AddSymbols(symbolRange(1, 10))
+	ibfB.AddSymbols(symbolRange(1, 10))
+	batchB, _ := ibfB.AddSymbols(symbolRange(1, 10))
+
+	if err := decoder.AddBatches(batchB, batchA); !errors.Is(err, ErrBatchOutOfOrder) {
+		t.Fatalf("got %v, want ErrBatchOutOfOrder", err)
+	}
+
+	truncated := CellBatch{Iteration: 1, Offset: 0, Cells: batchA.Cells[:1]}
+	if err := decoder.AddBatches(truncated, batchA); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("got %v, want ErrSizeMismatch", err)
+	}
+}
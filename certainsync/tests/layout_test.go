@@ -0,0 +1,99 @@
+package certainsync_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/holiman/uint256"
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+func TestDefaultLayoutFitsUniverse(t *testing.T) {
+	ibf := NewIBF(uint256.NewInt(1000000), &EGHMapping{})
+
+	want := CellLayout{CountBits: 64, XorSumBits: 20, HashSumBits: 64}
+	if ibf.Layout != want {
+		t.Fatalf("got layout %+v, want %+v", ibf.Layout, want)
+	}
+
+	batch, _ := ibf.AddSymbols(symbolRange(1, 10))
+	if got := batch.BitsLen(ibf.Layout); got != 2*148 {
+		t.Fatalf("batch of 2 cells uses %d bits, want %d", got, 2*148)
+	}
+}
+
+func TestLayoutOptions(t *testing.T) {
+	ibf := NewIBF(uint256.NewInt(1000), &EGHMapping{},
+		WithMaxSetSize(1000), WithFalsePurityProbability(1e-6))
+
+	want := CellLayout{CountBits: 11, XorSumBits: 10, HashSumBits: 20}
+	if ibf.Layout != want {
+		t.Fatalf("got layout %+v, want %+v", ibf.Layout, want)
+	}
+
+	// HashSum widths are capped to the hasher width.
+	wide := NewIBF(uint256.NewInt(1000), &EGHMapping{}, WithHashSumBits(100))
+	if wide.Layout.HashSumBits != 64 {
+		t.Fatalf("got %d HashSum bits for XXHash64, want 64", wide.Layout.HashSumBits)
+	}
+
+	other := NewIBF(uint256.NewInt(1000), &EGHMapping{})
+	ibf.AddSymbols(nil)
+	other.AddSymbols(nil)
+	if _, err := ibf.SubtractChecked(other); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("got %v, want ErrLayoutMismatch", err)
+	}
+}
+
+func TestNarrowCellsDecodeAfterWrapping(t *testing.T) {
+	universeSize := uint256.NewInt(5000)
+	mapping := &EGHMapping{}
+	opts := []IBFOption{WithCountBits(4), WithHashSumBits(24)}
+
+	// Both sets have far more symbols than 4-bit counts can hold,
+	// but the difference cells do not.
+	alice := symbolRange(1, 3000)
+	bob := append(symbolRange(1, 2995), symbolRange(4001, 4003)...)
+
+	ibfAlice := NewIBF(universeSize, mapping, opts...)
+	ibfBob := NewIBF(universeSize, mapping, opts...)
+
+	for {
+		ibfAlice.AddSymbols(alice)
+		ibfBob.AddSymbols(bob)
+
+		// Alice's cells go through the wire, wrapped to 4 bits.
+		data, err := ibfAlice.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %v", err)
+		}
+		var received InvertibleBloomFilter
+		if err := received.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary: %v", err)
+		}
+		assertSameIBF(t, ibfAlice, &received)
+		if received.Layout != ibfAlice.Layout {
+			t.Fatalf("got layout %+v, want %+v", received.Layout, ibfAlice.Layout)
+		}
+
+		diff, err := ibfBob.SubtractChecked(&received)
+		if err != nil {
+			t.Fatalf("SubtractChecked: %v", err)
+		}
+		bobWithoutAlice, aliceWithoutBob, err := diff.DecodeChecked()
+		if err != nil {
+			continue
+		}
+
+		if len(bobWithoutAlice) != 3 || len(aliceWithoutBob) != 5 {
+			t.Fatalf("decoded %d/%d symbols, want 3/5", len(bobWithoutAlice), len(aliceWithoutBob))
+		}
+		break
+	}
+
+	for _, cell := range ibfAlice.Cells[:ibfAlice.Size] {
+		if cell.Count < -8 || cell.Count > 7 || cell.HashSum.BitLen() > 24 {
+			t.Fatalf("cell %+v does not fit the layout", cell)
+		}
+	}
+}
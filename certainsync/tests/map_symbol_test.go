@@ -0,0 +1,123 @@
+package certainsync_test
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/holiman/uint256"
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+// mapSymbolIterations is the number of iterations each
+// benchmark loop maps a symbol for.
+const mapSymbolIterations = 64
+
+// randomHashes returns n random 256-bit symbols, like the
+// transaction hashes of a mempool.
+func randomHashes(n int, rng *rand.Rand) []*uint256.Int {
+	hashes := make([]*uint256.Int, n)
+	for i := range hashes {
+		hashes[i] = &uint256.Int{rng.Uint64(), rng.Uint64(), rng.Uint64(), rng.Uint64()}
+	}
+	return hashes
+}
+
+func TestMapSymbolDoesNotAllocate(t *testing.T) {
+	hashes := randomHashes(16, rand.New(rand.NewSource(1)))
+	mappings := []MappingMethod{
+		&EGHMapping{},
+		&OLSMapping{Order: uint256.NewInt(1000)},
+	}
+
+	for _, mapping := range mappings {
+		// Generate the primes before counting allocations.
+		mapping.GetAdditionalCellsCount(mapSymbolIterations)
+
+		allocs := testing.AllocsPerRun(100, func() {
+			for _, s := range hashes {
+				for i := uint64(1); i <= mapSymbolIterations; i++ {
+					mapping.MapSymbol(s, i)
+				}
+			}
+		})
+		if allocs != 0 {
+			t.Fatalf("%T.MapSymbol allocates %.1f times per run", mapping, allocs)
+		}
+	}
+}
+
+func TestMapSymbolMatchesUint256(t *testing.T) {
+	hashes := randomHashes(256, rand.New(rand.NewSource(2)))
+	hashes = append(hashes, uint256.NewInt(1), uint256.NewInt(math.MaxUint64), new(uint256.Int).SetAllOne())
+
+	egh := &EGHMapping{}
+	// A prime order, so the Latin squares use plain modular arithmetic.
+	ols := &OLSMapping{Order: uint256.NewInt(1009)}
+	order := ols.Order
+
+	for _, s := range hashes {
+		for i := uint64(1); i <= mapSymbolIterations; i++ {
+			p := uint256.NewInt(egh.GetAdditionalCellsCount(i))
+			if want := new(uint256.Int).Mod(s, p).Uint64(); egh.MapSymbol(s, i) != want {
+				t.Fatalf("EGH symbol %s iteration %d: got %d, want %d", s.Hex(), i, egh.MapSymbol(s, i), want)
+			}
+		}
+
+		symbolIndex := new(uint256.Int).Sub(s, uint256.NewInt(1))
+		row := new(uint256.Int).Div(symbolIndex, order)
+		row = row.Mod(row, order)
+		col := new(uint256.Int).Mod(symbolIndex, order).Uint64()
+		if got := ols.MapSymbol(s, 1); got != row.Uint64() {
+			t.Fatalf("OLS symbol %s: got row %d, want %d", s.Hex(), got, row.Uint64())
+		}
+		if want := (col + row.Uint64()*2) % order.Uint64(); ols.MapSymbol(s, 3) != want {
+			t.Fatalf("OLS symbol %s: got cell %d, want %d", s.Hex(), ols.MapSymbol(s, 3), want)
+		}
+	}
+}
+
+// benchmarkMapSymbol benchmarks mapping txpool sized sets of
+// hashes across mapSymbolIterations iterations.
+func benchmarkMapSymbol(b *testing.B, mapping MappingMethod) {
+	hashes := randomHashes(6000, rand.New(rand.NewSource(3)))
+	mapping.GetAdditionalCellsCount(mapSymbolIterations)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		for i := uint64(1); i <= mapSymbolIterations; i++ {
+			for _, s := range hashes {
+				mapping.MapSymbol(s, i)
+			}
+		}
+	}
+}
+
+func BenchmarkEGHMapSymbol(b *testing.B) {
+	benchmarkMapSymbol(b, &EGHMapping{})
+}
+
+func BenchmarkOLSMapSymbol(b *testing.B) {
+	benchmarkMapSymbol(b, &OLSMapping{Order: uint256.NewInt(1000)})
+}
+
+// BenchmarkEGHMapSymbolUint256Mod is the previous EGH mapping,
+// which reduced symbols with uint256 arithmetic, for comparison.
+func BenchmarkEGHMapSymbolUint256Mod(b *testing.B) {
+	hashes := randomHashes(6000, rand.New(rand.NewSource(3)))
+	egh := &EGHMapping{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		for i := uint64(1); i <= mapSymbolIterations; i++ {
+			p := egh.GetAdditionalCellsCount(i)
+			for _, s := range hashes {
+				new(uint256.Int).Mod(s, uint256.NewInt(p)).Uint64()
+			}
+		}
+	}
+}
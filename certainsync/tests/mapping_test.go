@@ -0,0 +1,309 @@
+package certainsync_test
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/holiman/uint256"
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+// decodeSuperset adds iterations to the IBFs of alice and bob, where
+// alice is a subset of bob, until the difference decodes or the
+// mapping runs out of cells. It returns the decoded symbols.
+func decodeSuperset(t *testing.T, universeSize *uint256.Int, mapping MappingMethod,
+	alice, bob []*uint256.Int, maxIterations int) []*uint256.Int {
+	t.Helper()
+
+	ibfAlice := NewIBF(universeSize, mapping)
+	ibfBob := NewIBF(universeSize, mapping)
+
+	for i := 0; i < maxIterations; i++ {
+		ibfAlice.AddSymbols(alice)
+		ibfBob.AddSymbols(bob)
+
+		bobWithoutAlice, aliceWithoutBob, ok := ibfBob.Subtract(ibfAlice).Decode()
+		if ok {
+			if len(aliceWithoutBob) != 0 {
+				t.Fatalf("decoded %d symbols missing from bob", len(aliceWithoutBob))
+			}
+			return bobWithoutAlice
+		}
+	}
+
+	t.Fatalf("%T did not decode after %d iterations", mapping, maxIterations)
+	return nil
+}
+
+func TestExtendedHammingListsUpToThreeSymbols(t *testing.T) {
+	const universe = 16
+	universeSize := uint256.NewInt(universe)
+	mapping := &ExtendedHammingMapping{UniverseSize: universeSize}
+
+	// 1 + 2*5 cells cover every bit of a 16 element universe.
+	maxIterations := 1 + 5
+
+	diffs := [][]uint64{{7}, {1, 16}, {3, 5, 6}, {1, 2, 4}, {8, 9, 16}}
+	for _, diff := range diffs {
+		missing := make(map[uint64]bool)
+		for _, s := range diff {
+			missing[s] = true
+		}
+
+		bob := symbolRange(1, universe)
+		alice := make([]*uint256.Int, 0, universe)
+		for _, s := range bob {
+			if !missing[s.Uint64()] {
+				alice = append(alice, s)
+			}
+		}
+
+		decoded := decodeSuperset(t, universeSize, mapping, alice, bob, maxIterations)
+		if len(decoded) != len(diff) {
+			t.Fatalf("diff %v: decoded %d symbols", diff, len(decoded))
+		}
+		for _, s := range decoded {
+			if !missing[s.Uint64()] {
+				t.Fatalf("diff %v: decoded unexpected symbol %d", diff, s.Uint64())
+			}
+		}
+	}
+}
+
+func TestExtendedHammingRunsOutOfCells(t *testing.T) {
+	mapping := &ExtendedHammingMapping{UniverseSize: uint256.NewInt(8)}
+
+	// Periods 1, 2, 4 and 8 fit a universe of 8.
+	wantCells := []uint64{1, 2, 2, 2, 2, 0, 0}
+	for i, want := range wantCells {
+		if got := mapping.GetAdditionalCellsCount(uint64(i + 1)); got != want {
+			t.Fatalf("iteration %d: got %d cells, want %d", i+1, got, want)
+		}
+	}
+
+	ibf := NewIBF(uint256.NewInt(8), mapping)
+	for i := range wantCells {
+		_, err := ibf.AddSymbols(symbolRange(1, 8))
+		if exhausted := wantCells[i] == 0; exhausted != errors.Is(err, ErrIterationsExhausted) {
+			t.Fatalf("iteration %d: got error %v", i+1, err)
+		}
+	}
+	if ibf.Size != 9 || ibf.Iteration != 5 {
+		t.Fatalf("got %d cells after %d iterations, want 9 after 5", ibf.Size, ibf.Iteration)
+	}
+}
+
+func TestSparseMatrixMappingDecodes(t *testing.T) {
+	// Every symbol of a universe of 6 is mapped to a distinct pair
+	// of the 4 rows of the first block, and the second block repeats
+	// the first block rows in reverse.
+	pairs := [][]uint64{{0, 1}, {0, 2}, {0, 3}, {1, 2}, {1, 3}, {2, 3}}
+	reversed := make([][]uint64, len(pairs))
+	for i := range pairs {
+		reversed[i] = pairs[len(pairs)-1-i]
+	}
+	mapping := &SparseMatrixMapping{
+		Blocks: []SparseBlock{
+			{Rows: 4, Columns: pairs},
+			{Rows: 4, Columns: reversed},
+		},
+	}
+
+	universeSize := uint256.NewInt(6)
+	bob := symbolRange(1, 6)
+	alice := []*uint256.Int{bob[0], bob[1], bob[3], bob[4]}
+
+	decoded := decodeSuperset(t, universeSize, mapping, alice, bob, 2)
+	if len(decoded) != 2 {
+		t.Fatalf("decoded %d symbols, want 2", len(decoded))
+	}
+	for _, s := range decoded {
+		if s.Uint64() != 3 && s.Uint64() != 6 {
+			t.Fatalf("decoded unexpected symbol %d", s.Uint64())
+		}
+	}
+
+	// Each symbol is counted once per row it is mapped to.
+	ibf := NewIBF(universeSize, mapping)
+	ibf.AddSymbols(bob)
+	for j, cell := range ibf.Cells {
+		if cell.Count != 3 {
+			t.Fatalf("cell %d has count %d, want 3", j, cell.Count)
+		}
+	}
+}
+
+func TestEGHMappingPanicsOnIterationZero(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("iteration 0 did not panic")
+		}
+	}()
+	(&EGHMapping{Primes: NewPrimeSource()}).GetAdditionalCellsCount(0)
+}
+
+func TestAsMultiMappingAdaptsSingleCellMappings(t *testing.T) {
+	mapping := &EGHMapping{}
+	multi := AsMultiMapping(mapping)
+
+	for s := uint64(1); s <= 20; s++ {
+		symbol := uint256.NewInt(s)
+		for iteration := uint64(1); iteration <= 4; iteration++ {
+			cells := multi.MapSymbolMulti(symbol, iteration)
+			if len(cells) != 1 || cells[0] != mapping.MapSymbol(symbol, iteration) {
+				t.Fatalf("symbol %d iteration %d: got cells %v", s, iteration, cells)
+			}
+		}
+	}
+
+	sparse := &SparseMatrixMapping{}
+	if AsMultiMapping(sparse) != MultiMappingMethod(sparse) {
+		t.Fatalf("multi-cell mapping was wrapped")
+	}
+}
+
+func TestOLSFieldOrder(t *testing.T) {
+	orders := map[uint64]uint64{1: 2, 8: 8, 9: 9, 10: 11, 26: 27, 120: 121, 1000: 1009}
+	for order, want := range orders {
+		if got := NewOLSMapping(uint256.NewInt(order)).FieldOrder(); !got.Eq(uint256.NewInt(want)) {
+			t.Fatalf("order %d: got field order %d, want %d", order, got, want)
+		}
+	}
+}
+
+func TestOLSMappingIsOrthogonal(t *testing.T) {
+	for _, order := range []uint64{7, 8, 9, 16, 25, 27} {
+		mapping := &OLSMapping{Order: uint256.NewInt(order)}
+		q := mapping.FieldOrder().Uint64()
+		iterations := mapping.MaxIterations()
+		symbols := symbolRange(1, q*q)
+
+		cells := make([][]uint64, iterations+1)
+		for i := uint64(1); i <= iterations; i++ {
+			cells[i] = make([]uint64, len(symbols))
+			load := make([]uint64, q)
+			for k, s := range symbols {
+				cells[i][k] = mapping.MapSymbol(s, i)
+				load[cells[i][k]]++
+			}
+			for cell, n := range load {
+				if n != q {
+					t.Fatalf("q=%d iteration %d: cell %d holds %d symbols, want %d", q, i, cell, n, q)
+				}
+			}
+		}
+
+		// Two symbols share a cell in at most one iteration.
+		for i := uint64(1); i <= iterations; i++ {
+			for j := i + 1; j <= iterations; j++ {
+				seen := make(map[[2]uint64]bool)
+				for k := range symbols {
+					pair := [2]uint64{cells[i][k], cells[j][k]}
+					if seen[pair] {
+						t.Fatalf("q=%d: iterations %d and %d are not orthogonal", q, i, j)
+					}
+					seen[pair] = true
+				}
+			}
+		}
+	}
+}
+
+func TestOLSMappingRunsOutOfSquares(t *testing.T) {
+	mapping := &OLSMapping{Order: uint256.NewInt(9)}
+	ibf := NewIBF(uint256.NewInt(81), mapping)
+
+	for i := uint64(1); i <= mapping.MaxIterations(); i++ {
+		if _, err := ibf.AddSymbols(symbolRange(1, 81)); err != nil {
+			t.Fatalf("iteration %d: %v", i, err)
+		}
+	}
+	if _, err := ibf.AddSymbols(symbolRange(1, 81)); !errors.Is(err, ErrIterationsExhausted) {
+		t.Fatalf("got %v, want ErrIterationsExhausted", err)
+	}
+}
+
+func TestOLSOrderForUniverse(t *testing.T) {
+	two128 := new(uint256.Int).Lsh(uint256.NewInt(1), 128)
+	universes := []struct {
+		universeSize, order *uint256.Int
+	}{
+		{uint256.NewInt(1000000), uint256.NewInt(1000)},
+		{uint256.NewInt(1000001), uint256.NewInt(1001)},
+		{new(uint256.Int).SetAllOne(), two128},
+	}
+
+	for _, u := range universes {
+		if got := OLSOrderForUniverse(u.universeSize); !got.Eq(u.order) {
+			t.Fatalf("universe %s: got order %s, want %s", u.universeSize.Dec(), got.Dec(), u.order.Dec())
+		}
+	}
+
+	wide := &OLSMapping{Order: two128}
+	if !wide.FieldOrder().Eq(two128) {
+		t.Fatalf("got field order %s, want 2^128", wide.FieldOrder().Dec())
+	}
+}
+
+func TestOLSMappingOnRawHashes(t *testing.T) {
+	universeSize := new(uint256.Int).SetAllOne()
+	mapping := &OLSMapping{Order: OLSOrderForUniverse(universeSize), Cells: 64}
+
+	bob := randomHashes(2000, rand.New(rand.NewSource(4)))
+	alice := bob[:1970]
+
+	decoded := decodeSuperset(t, universeSize, mapping, alice, bob, 100)
+	if len(decoded) != 30 {
+		t.Fatalf("decoded %d symbols, want 30", len(decoded))
+	}
+
+	// Symbols sharing a row are separated by every Latin square.
+	row := new(uint256.Int).Lsh(uint256.NewInt(5), 128)
+	s1 := new(uint256.Int).AddUint64(row, 1)
+	s2 := new(uint256.Int).AddUint64(row, 2)
+	if mapping.MapSymbol(s1, 1) != mapping.MapSymbol(s2, 1) {
+		t.Fatalf("symbols of the same row map to different first iteration cells")
+	}
+	for i := uint64(2); i <= 10; i++ {
+		if mapping.MapSymbol(s1, i) == mapping.MapSymbol(s2, i) {
+			t.Fatalf("iteration %d maps neighboring columns to the same cell", i)
+		}
+	}
+}
+
+func TestOLSFolded(t *testing.T) {
+	if NewOLSMapping(uint256.NewInt(1000)).Folded() {
+		t.Fatal("order 1000 is folded")
+	}
+
+	wide := &OLSMapping{Order: OLSOrderForUniverse(new(uint256.Int).SetAllOne()), Cells: 50}
+	if !wide.Folded() {
+		t.Fatal("order 2^128 is not folded")
+	}
+	if cells := wide.GetAdditionalCellsCount(1); cells != 50 {
+		t.Fatalf("got %d cells per iteration, want 50", cells)
+	}
+
+	// Cells only applies to folded squares.
+	if cells := (&OLSMapping{Order: uint256.NewInt(32), Cells: 5}).GetAdditionalCellsCount(1); cells != 32 {
+		t.Fatalf("got %d cells per iteration, want 32", cells)
+	}
+
+	// A 2^96 universe fits in 64-bit orders, but not in the cells
+	// practical per iteration.
+	universeSize := new(uint256.Int).Lsh(uint256.NewInt(1), 96)
+	mid := &OLSMapping{Order: OLSOrderForUniverse(universeSize)}
+	if !mid.Folded() {
+		t.Fatal("order 2^48 is not folded")
+	}
+	bob := randomHashes(200, rand.New(rand.NewSource(5)))
+	for _, s := range bob {
+		s.Mod(s, universeSize)
+		s.AddUint64(s, 1)
+	}
+	decoded := decodeSuperset(t, universeSize, mid, bob[:190], bob, 100)
+	if len(decoded) != 10 {
+		t.Fatalf("decoded %d symbols, want 10", len(decoded))
+	}
+}
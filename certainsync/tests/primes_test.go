@@ -0,0 +1,75 @@
+package certainsync_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/holiman/uint256"
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+// isPrime checks primality by trial division.
+func isPrime(n uint64) bool {
+	if n < 2 {
+		return false
+	}
+	for d := uint64(2); d*d <= n; d++ {
+		if n%d == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPrimeSourceMatchesTrialDivision(t *testing.T) {
+	ps := NewPrimeSource()
+
+	i := uint64(0)
+	for n := uint64(2); n < 200000; n++ {
+		if !isPrime(n) {
+			continue
+		}
+		if got := ps.Prime(i); got != n {
+			t.Fatalf("Prime(%d) = %d, want %d", i, got, n)
+		}
+		i++
+	}
+}
+
+func TestPrimeSourceConcurrentUse(t *testing.T) {
+	ps := NewPrimeSource()
+
+	// The 100000th prime, past the range sieved by the old
+	// package initialization.
+	const index, want = 99999, 1299709
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := uint64(g); i <= index; i += 997 {
+				ps.Prime(i)
+			}
+			if got := ps.Prime(index); got != want {
+				t.Errorf("Prime(%d) = %d, want %d", index, got, want)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestEGHMappingBeyondSievedPrimes(t *testing.T) {
+	mapping := &EGHMapping{Primes: NewPrimeSource()}
+
+	const iteration = 100000
+	p := mapping.GetAdditionalCellsCount(iteration)
+	if p != 1299709 {
+		t.Fatalf("iteration %d uses prime %d, want 1299709", iteration, p)
+	}
+
+	symbol := uint256.NewInt(5*1299709 + 42)
+	if got := mapping.MapSymbol(symbol, iteration); got != 42 {
+		t.Fatalf("MapSymbol = %d, want 42", got)
+	}
+}
@@ -0,0 +1,478 @@
+package certainsync_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/holiman/uint256"
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+	"github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync/session"
+)
+
+// sessionOutcome is the result of one side of a session.
+type sessionOutcome struct {
+	result *session.Result
+	err    error
+}
+
+// runSession runs a session between a sender and a receiver over
+// net.Pipe and returns the outcome of both sides.
+func runSession(t *testing.T, sender *session.Sender, receiver *session.Receiver) (sessionOutcome, sessionOutcome) {
+	t.Helper()
+
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	done := make(chan sessionOutcome)
+	go func() {
+		result, err := receiver.Run(context.Background(), receiverConn)
+		if err != nil && !errors.Is(err, session.ErrIncomplete) {
+			receiverConn.Close()
+		}
+		done <- sessionOutcome{result, err}
+	}()
+
+	result, err := sender.Run(context.Background(), senderConn)
+	if err != nil && !errors.Is(err, session.ErrIncomplete) {
+		senderConn.Close()
+	}
+	return sessionOutcome{result, err}, <-done
+}
+
+// assertSymbols fails the test if got does not hold the symbols of want.
+func assertSymbols(t *testing.T, name string, got, want []*uint256.Int) {
+	t.Helper()
+
+	sorted := append([]*uint256.Int(nil), got...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Lt(sorted[j]) })
+	if len(sorted) != len(want) {
+		t.Fatalf("%s: got %d symbols, want %d", name, len(sorted), len(want))
+	}
+	for i := range want {
+		if !sorted[i].Eq(want[i]) {
+			t.Fatalf("%s: got %s, want %s", name, sorted[i].Dec(), want[i].Dec())
+		}
+	}
+}
+
+func TestSessionOverPipe(t *testing.T) {
+	universeSize := uint256.NewInt(100000)
+	senderSet := symbolRange(1, 5000)
+	receiverSet := symbolRange(21, 5030)
+
+	tests := []struct {
+		name    string
+		mapping MappingMethod
+		opts    []IBFOption
+	}{
+		{"EGH", &EGHMapping{}, nil},
+		{"OLS", &OLSMapping{Order: OLSOrderForUniverse(universeSize), Cells: 100}, nil},
+		{"Murmur3", &EGHMapping{}, []IBFOption{WithHasher(Murmur3Hash{}), WithMaxSetSize(5030), WithHashSumBits(32)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := session.NewSender(senderSet, universeSize, tt.mapping, tt.opts...)
+			receiver := session.NewReceiver(receiverSet)
+
+			s, r := runSession(t, sender, receiver)
+			if s.err != nil || r.err != nil {
+				t.Fatalf("sender: %v, receiver: %v", s.err, r.err)
+			}
+
+			assertSymbols(t, "sender only", s.result.LocalOnly, symbolRange(1, 20))
+			assertSymbols(t, "receiver only", s.result.RemoteOnly, symbolRange(5001, 5030))
+			assertSymbols(t, "sender only", r.result.RemoteOnly, symbolRange(1, 20))
+			assertSymbols(t, "receiver only", r.result.LocalOnly, symbolRange(5001, 5030))
+
+			// The sender may send batches the receiver no longer needs.
+			if s.result.Iterations < r.result.Iterations {
+				t.Fatalf("sender sent %d batches, receiver used %d", s.result.Iterations, r.result.Iterations)
+			}
+			if s.result.BytesSent != r.result.BytesReceived || r.result.BytesSent != s.result.BytesReceived {
+				t.Fatalf("sender sent %d and received %d bytes, receiver received %d and sent %d",
+					s.result.BytesSent, s.result.BytesReceived, r.result.BytesReceived, r.result.BytesSent)
+			}
+		})
+	}
+}
+
+func TestSessionSuperset(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+
+	// The sender holds every symbol of the receiver.
+	sender := session.NewSender(symbolRange(1, 1000), universeSize, &EGHMapping{}, WithSuperset())
+	receiver := session.NewReceiver(append(symbolRange(1, 400), symbolRange(411, 1000)...))
+
+	s, r := runSession(t, sender, receiver)
+	if s.err != nil || r.err != nil {
+		t.Fatalf("sender: %v, receiver: %v", s.err, r.err)
+	}
+	assertSymbols(t, "sender only", r.result.RemoteOnly, symbolRange(401, 410))
+	assertSymbols(t, "receiver only", r.result.LocalOnly, nil)
+
+	// A receiver with symbols the sender lacks breaks the assumption.
+	sender = session.NewSender(symbolRange(1, 900), universeSize, &EGHMapping{}, WithSuperset())
+	receiver = session.NewReceiver(symbolRange(1, 901))
+
+	s, r = runSession(t, sender, receiver)
+	if !errors.Is(s.err, session.ErrIncomplete) || !errors.Is(r.err, ErrSupersetViolation) {
+		t.Fatalf("sender: %v, receiver: %v, want ErrIncomplete and ErrSupersetViolation", s.err, r.err)
+	}
+}
+
+func TestSessionIncomplete(t *testing.T) {
+	universeSize := uint256.NewInt(10000)
+
+	// OLS of order 4 has 5 iterations of 4 cells, too few to list
+	// a difference of 200 symbols.
+	mapping := &OLSMapping{Order: uint256.NewInt(4)}
+	sender := session.NewSender(symbolRange(1, 16), universeSize, mapping)
+	receiver := session.NewReceiver(symbolRange(1, 200))
+
+	s, r := runSession(t, sender, receiver)
+	if !errors.Is(s.err, session.ErrIncomplete) || !errors.Is(r.err, session.ErrIncomplete) {
+		t.Fatalf("sender: %v, receiver: %v, want ErrIncomplete", s.err, r.err)
+	}
+	if s.result.Iterations != 5 || r.result.Iterations != 5 {
+		t.Fatalf("sender sent %d batches, receiver got %d, want 5", s.result.Iterations, r.result.Iterations)
+	}
+}
+
+func TestSessionRejectsUnexpectedMessage(t *testing.T) {
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	go func() {
+		session.NewConn(senderConn).WriteMessage(session.Stop{})
+	}()
+
+	_, err := session.NewReceiver(nil).Run(context.Background(), receiverConn)
+	if !errors.Is(err, session.ErrUnexpectedMessage) {
+		t.Fatalf("got %v, want ErrUnexpectedMessage", err)
+	}
+}
+
+func TestSessionHandshakeFallback(t *testing.T) {
+	universeSize := uint256.NewInt(10000)
+	senderSet := symbolRange(1, 1000)
+	receiverSet := symbolRange(11, 1000)
+
+	tests := []struct {
+		name         string
+		sender       *session.Sender
+		receiver     *session.Receiver
+		receiverOnly []*uint256.Int
+		wantParams   func(session.Params) bool
+	}{
+		{
+			"MappingFallsBackToEGH",
+			session.NewSender(senderSet, universeSize, &OLSMapping{Order: OLSOrderForUniverse(universeSize)}),
+			session.NewReceiver(receiverSet, session.AcceptMappings(EGHMappingName)),
+			nil,
+			func(p session.Params) bool { return p.Mapping.Name == EGHMappingName },
+		},
+		{
+			"HasherFallsBackToDefault",
+			session.NewSender(senderSet, universeSize, &EGHMapping{}, WithHasher(Sha256Hash{})),
+			session.NewReceiver(receiverSet, session.AcceptHashers(XXHash64HasherName, Murmur3HasherName)),
+			nil,
+			func(p session.Params) bool { return p.Hasher == XXHash64HasherName && p.Layout.HashSumBits == 64 },
+		},
+		{
+			"UniverseGrowsToReceiverSet",
+			session.NewSender(senderSet, uint256.NewInt(1000), &OLSMapping{Order: uint256.NewInt(32)}),
+			session.NewReceiver(append(symbolRange(11, 1000), uint256.NewInt(5000))),
+			[]*uint256.Int{uint256.NewInt(5000)},
+			func(p session.Params) bool {
+				return p.Mapping.Name == EGHMappingName && p.UniverseSize.Eq(uint256.NewInt(5000))
+			},
+		},
+		{
+			// The sender's key is replaced by the session seed.
+			"KeyedHasherUsesSessionSeed",
+			session.NewSender(senderSet, universeSize, &EGHMapping{}, WithHasher(NewBlake2bHash(nil))),
+			session.NewReceiver(receiverSet),
+			nil,
+			func(p session.Params) bool { return p.Hasher == Blake2bHasherName && len(p.Seed) == SessionSeedSize },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, r := runSession(t, tt.sender, tt.receiver)
+			if s.err != nil || r.err != nil {
+				t.Fatalf("sender: %v, receiver: %v", s.err, r.err)
+			}
+			if !tt.wantParams(s.result.Params) || !tt.wantParams(r.result.Params) {
+				t.Fatalf("agreed on %+v and %+v", s.result.Params, r.result.Params)
+			}
+			if !bytes.Equal(s.result.Params.Seed, r.result.Params.Seed) {
+				t.Fatalf("sender and receiver have different seeds")
+			}
+			assertSymbols(t, "sender only", r.result.RemoteOnly, symbolRange(1, 10))
+			assertSymbols(t, "receiver only", r.result.LocalOnly, tt.receiverOnly)
+		})
+	}
+}
+
+func TestSessionHandshakeRejects(t *testing.T) {
+	universeSize := uint256.NewInt(10000)
+
+	// EGH, the fallback mapping, is not accepted either.
+	sender := session.NewSender(symbolRange(1, 100), universeSize, &EGHMapping{})
+	receiver := session.NewReceiver(symbolRange(1, 100), session.AcceptMappings(OLSMappingName))
+	s, r := runSession(t, sender, receiver)
+	if !errors.Is(s.err, session.ErrRejected) || !errors.Is(r.err, session.ErrRejected) {
+		t.Fatalf("sender: %v, receiver: %v, want ErrRejected", s.err, r.err)
+	}
+
+	// The receiver's fallback universe does not hold the sender's set.
+	sender = session.NewSender(append(symbolRange(1, 1000), uint256.NewInt(6000)), uint256.NewInt(1000), &EGHMapping{})
+	receiver = session.NewReceiver(append(symbolRange(11, 1000), uint256.NewInt(5000)))
+	s, r = runSession(t, sender, receiver)
+	if !errors.Is(s.err, session.ErrRejected) || r.err == nil {
+		t.Fatalf("sender: %v, receiver: %v, want ErrRejected", s.err, r.err)
+	}
+
+	// Other protocol versions are rejected without a fallback.
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := session.NewReceiver(nil).Run(context.Background(), receiverConn)
+		done <- err
+	}()
+
+	conn := session.NewConn(senderConn)
+	params := session.Params{
+		UniverseSize: universeSize,
+		Mapping:      MappingDescriptor{Name: EGHMappingName},
+		Hasher:       XXHash64HasherName,
+		Layout:       CellLayout{CountBits: 64, XorSumBits: 14, HashSumBits: 64},
+	}
+	if err := conn.WriteMessage(session.Hello{Version: session.ProtocolVersion + 1, Params: params}); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	m, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if reject, ok := m.(session.Reject); !ok || reject.Fallback != nil {
+		t.Fatalf("got %+v, want a Reject without fallback", m)
+	}
+	if err := <-done; !errors.Is(err, session.ErrRejected) {
+		t.Fatalf("got %v, want ErrRejected", err)
+	}
+}
+
+func TestSessionSeedNeedsBothNonces(t *testing.T) {
+	params, err := session.ParamsOf(NewIBF(uint256.NewInt(1000), &EGHMapping{}, WithHasher(NewBlake2bHash(nil))))
+	if err != nil {
+		t.Fatalf("ParamsOf: %v", err)
+	}
+	params.Seed = bytes.Repeat([]byte{7}, SessionSeedSize)
+
+	// The same Hello gives sessions of different seeds, none of them
+	// the seed chosen by the sender.
+	var seeds [][]byte
+	for i := 0; i < 2; i++ {
+		senderConn, receiverConn := net.Pipe()
+		done := make(chan sessionOutcome)
+		go func() {
+			result, err := session.NewReceiver(symbolRange(1, 100)).Run(context.Background(), receiverConn)
+			done <- sessionOutcome{result, err}
+		}()
+
+		conn := session.NewConn(senderConn)
+		if err := conn.WriteMessage(session.Hello{Version: session.ProtocolVersion, Params: params}); err != nil {
+			t.Fatalf("WriteMessage: %v", err)
+		}
+		m, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		if accept, ok := m.(session.Accept); !ok || len(accept.Nonce) != SessionSeedSize {
+			t.Fatalf("got %+v, want an Accept with a nonce", m)
+		}
+		senderConn.Close()
+
+		r := <-done
+		receiverConn.Close()
+		if r.result == nil || len(r.result.Params.Seed) != SessionSeedSize || bytes.Equal(r.result.Params.Seed, params.Seed) {
+			t.Fatalf("receiver keyed the session with %x, sender seed %x", r.result.Params.Seed, params.Seed)
+		}
+		seeds = append(seeds, r.result.Params.Seed)
+	}
+	if bytes.Equal(seeds[0], seeds[1]) {
+		t.Fatal("two sessions with the same Hello have the same seed")
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	universeSize := uint256.NewInt(100000)
+	// The sender holds 1..100 and the receiver 1001..1100 on their own.
+	senderSet := symbolRange(1, 1000)
+	receiverSet := symbolRange(101, 1100)
+
+	tests := []struct {
+		name          string
+		mapping       MappingMethod
+		sender        session.Limits
+		receiver      session.Limits
+		senderErr     error
+		receiverErr   error
+		maxIterations uint64
+	}{
+		{"ReceiverIterations", &EGHMapping{}, session.Limits{}, session.Limits{MaxIterations: 5},
+			session.ErrIncomplete, session.ErrIterationLimit, 5},
+		{"SenderIterations", &EGHMapping{}, session.Limits{MaxIterations: 3}, session.Limits{},
+			session.ErrIterationLimit, session.ErrIncomplete, 3},
+		{"ReceiverCells", &EGHMapping{}, session.Limits{}, session.Limits{MaxCells: 50},
+			session.ErrIncomplete, session.ErrCellLimit, 6},
+		{"SenderCells", &EGHMapping{}, session.Limits{MaxCells: 50}, session.Limits{},
+			session.ErrCellLimit, session.ErrIncomplete, 6},
+		{"DecodedSymbols", &EGHMapping{}, session.Limits{}, session.Limits{MaxDecodedSymbols: 50},
+			session.ErrIncomplete, session.ErrSymbolLimit, 1000},
+		{"MessageSize", &OLSMapping{Order: OLSOrderForUniverse(universeSize), Cells: 100}, session.Limits{}, session.Limits{MaxMessageSize: 64},
+			nil, session.ErrMessageTooLarge, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := session.NewSender(senderSet, universeSize, tt.mapping)
+			sender.Limits = tt.sender
+			receiver := session.NewReceiver(receiverSet)
+			receiver.Limits = tt.receiver
+
+			s, r := runSession(t, sender, receiver)
+			if s.err == nil || tt.senderErr != nil && !errors.Is(s.err, tt.senderErr) {
+				t.Fatalf("sender: got %v, want %v", s.err, tt.senderErr)
+			}
+			if !errors.Is(r.err, tt.receiverErr) {
+				t.Fatalf("receiver: got %v, want %v", r.err, tt.receiverErr)
+			}
+			if r.result.Iterations > tt.maxIterations {
+				t.Fatalf("receiver added %d batches, want at most %d", r.result.Iterations, tt.maxIterations)
+			}
+
+			// The partial difference only holds symbols of the difference.
+			for _, x := range r.result.RemoteOnly {
+				if x.GtUint64(100) {
+					t.Fatalf("%s is not only in the sender's set", x.Dec())
+				}
+			}
+			for _, x := range r.result.LocalOnly {
+				if x.LtUint64(1001) {
+					t.Fatalf("%s is not only in the receiver's set", x.Dec())
+				}
+			}
+			if limit := tt.receiver.MaxDecodedSymbols; limit != 0 {
+				for _, result := range []*session.Result{s.result, r.result} {
+					if n := len(result.LocalOnly) + len(result.RemoteOnly); n > limit {
+						t.Fatalf("got %d symbols, want at most %d", n, limit)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSessionCellLimitOfMapping(t *testing.T) {
+	universeSize := uint256.NewInt(10000)
+	// One iteration of OLS of this order adds millions of cells.
+	order := uint256.NewInt(1 << 21)
+	limits := session.Limits{MaxCells: 1000}
+
+	// The receiver falls back to EGH, whose iterations fit.
+	sender := session.NewSender(symbolRange(1, 1000), universeSize, &OLSMapping{Order: order})
+	receiver := session.NewReceiver(symbolRange(11, 1000))
+	receiver.Limits = limits
+	s, r := runSession(t, sender, receiver)
+	if s.err != nil || r.err != nil {
+		t.Fatalf("sender: %v, receiver: %v", s.err, r.err)
+	}
+	if name := r.result.Params.Mapping.Name; name != EGHMappingName {
+		t.Fatalf("agreed on %s, want %s", name, EGHMappingName)
+	}
+	assertSymbols(t, "sender only", r.result.RemoteOnly, symbolRange(1, 10))
+
+	// Without the fallback, the mapping is rejected.
+	sender = session.NewSender(symbolRange(1, 1000), universeSize, &OLSMapping{Order: order})
+	receiver = session.NewReceiver(symbolRange(11, 1000), session.AcceptMappings(OLSMappingName))
+	receiver.Limits = limits
+	s, r = runSession(t, sender, receiver)
+	if !errors.Is(s.err, session.ErrRejected) || !errors.Is(r.err, session.ErrRejected) {
+		t.Fatalf("sender: %v, receiver: %v, want ErrRejected", s.err, r.err)
+	}
+}
+
+// runStalledSession runs receiver with ctx against a sender that
+// stalls after the handshake, and returns the outcome of the receiver.
+func runStalledSession(t *testing.T, ctx context.Context, receiver *session.Receiver) sessionOutcome {
+	t.Helper()
+
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	done := make(chan sessionOutcome)
+	go func() {
+		result, err := receiver.Run(ctx, receiverConn)
+		done <- sessionOutcome{result, err}
+	}()
+
+	params, err := session.ParamsOf(NewIBF(uint256.NewInt(1000), &EGHMapping{}))
+	if err != nil {
+		t.Fatalf("ParamsOf: %v", err)
+	}
+	conn := session.NewConn(senderConn)
+	if err := conn.WriteMessage(session.Hello{Version: session.ProtocolVersion, Params: params}); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	if m, err := conn.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	} else if _, ok := m.(session.Accept); !ok {
+		t.Fatalf("got %T, want Accept", m)
+	}
+
+	select {
+	case r := <-done:
+		if r.result == nil || r.result.Params.Mapping.Name != EGHMappingName {
+			t.Fatalf("got result %+v, want the agreed parameters", r.result)
+		}
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiver did not give up")
+		return sessionOutcome{}
+	}
+}
+
+func TestSessionDeadline(t *testing.T) {
+	receiver := session.NewReceiver(symbolRange(1, 100))
+	receiver.Limits.Timeout = 50 * time.Millisecond
+
+	r := runStalledSession(t, context.Background(), receiver)
+	if !errors.Is(r.err, session.ErrDeadline) {
+		t.Fatalf("got %v, want ErrDeadline", r.err)
+	}
+}
+
+func TestSessionCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	r := runStalledSession(t, ctx, session.NewReceiver(symbolRange(1, 100)))
+	if !errors.Is(r.err, context.Canceled) || errors.Is(r.err, session.ErrDeadline) {
+		t.Fatalf("got %v, want context.Canceled", r.err)
+	}
+}
@@ -59,10 +59,16 @@ func runTrialSuccessRateVsTotalBits(trialNumber int,
 		ibfBob = NewIBF(uint256.NewInt(uint64(universeSize)), &EGHMapping{})
 	case OLS:
 		olsMapping := OLSMapping{
-			Order: uint64(math.Ceil(math.Sqrt(float64(universeSize)))),
+			Order: uint256.NewInt(uint64(math.Ceil(math.Sqrt(float64(universeSize))))),
 		}
 		ibfAlice = NewIBF(uint256.NewInt(uint64(universeSize)), &olsMapping)
 		ibfBob = NewIBF(uint256.NewInt(uint64(universeSize)), &olsMapping)
+	case ExtendedHamming:
+		extendedHammingMapping := ExtendedHammingMapping{
+			UniverseSize: uint256.NewInt(uint64(universeSize)),
+		}
+		ibfAlice = NewIBF(uint256.NewInt(uint64(universeSize)), &extendedHammingMapping)
+		ibfBob = NewIBF(uint256.NewInt(uint64(universeSize)), &extendedHammingMapping)
 	}
 
 	// Initialize the results to store success rate vs. total bits
@@ -70,13 +76,18 @@ func runTrialSuccessRateVsTotalBits(trialNumber int,
 	transmittedBits := uint64(0)
 	curSymmetricDiffSize := 0
 
-	// Continue transmitting coded symbols until symmetricDiffSize elements are decoded
-	for curSymmetricDiffSize < symmetricDiffSize {
-		ibfAlice.AddSymbols(alice)
+	// Continue transmitting coded symbols until symmetricDiffSize elements are decoded,
+	// or a bounded mapping runs out of iterations
+	for curSymmetricDiffSize < symmetricDiffSize && ibfAlice.Iteration < maxIterations(ibfAlice) {
+		if _, err := ibfAlice.AddSymbols(alice); err != nil {
+			panic(err)
+		}
 
 		transmittedBits = ibfAlice.GetTransmittedBitsSize()
 
-		ibfBob.AddSymbols(bob)
+		if _, err := ibfBob.AddSymbols(bob); err != nil {
+			panic(err)
+		}
 
 		// Subtract the two IBFs and Decode the result to find the differences
 		ibfDiff := ibfBob.Subtract(ibfAlice)
@@ -120,10 +131,14 @@ func BenchmarkSuccessRateVsTotalBits(b *testing.B) {
 
 	numTrials := 10
 
-	mappingTypes := []MappingType{EGH, OLS}
+	mappingTypes := []MappingType{EGH, OLS, ExtendedHamming}
 
 	for _, mappingType := range mappingTypes {
 		for _, symmetricDiffSize := range symmetricDiffSizes {
+			if mappingType == ExtendedHamming && symmetricDiffSize > extendedHammingMaxDiffSize {
+				continue
+			}
+
 			b.Run(fmt.Sprintf("DiffSize=%d", symmetricDiffSize), func(b *testing.B) {
 				filename := fmt.Sprintf("%s_success_rate_vs_total_bits_diff_size_%d_set_inside_set.csv", string(mappingType), symmetricDiffSize)
 
@@ -0,0 +1,93 @@
+package certainsync_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/holiman/uint256"
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+func TestSupersetDecodesWithoutHashSum(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+	mapping := &EGHMapping{}
+
+	bob := symbolRange(1, 1000)
+	alice := append(symbolRange(1, 400), symbolRange(411, 1000)...)
+
+	ibfAlice := NewIBF(universeSize, mapping, WithSuperset())
+	ibfBob := NewIBF(universeSize, mapping, WithSuperset())
+	full := NewIBF(universeSize, mapping)
+
+	for {
+		ibfAlice.AddSymbols(alice)
+		ibfBob.AddSymbols(bob)
+		full.AddSymbols(alice)
+
+		diff, err := ibfBob.SubtractChecked(ibfAlice)
+		if err != nil {
+			t.Fatalf("SubtractChecked: %v", err)
+		}
+		bobWithoutAlice, aliceWithoutBob, err := diff.DecodeChecked()
+		if err != nil {
+			continue
+		}
+
+		if len(bobWithoutAlice) != 10 || len(aliceWithoutBob) != 0 {
+			t.Fatalf("decoded %d/%d symbols, want 10/0", len(bobWithoutAlice), len(aliceWithoutBob))
+		}
+		break
+	}
+
+	// Superset cells drop their HashSum.
+	want := full.GetTransmittedBitsSize() - full.Size*uint64(full.Layout.HashSumBits)
+	if got := ibfAlice.GetTransmittedBitsSize(); got != want {
+		t.Fatalf("superset IBF uses %d bits, want %d", got, want)
+	}
+
+	data, err := ibfAlice.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	var decoded InvertibleBloomFilter
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if !decoded.Superset || !decoded.Cells[0].HashSum.IsZero() {
+		t.Fatalf("decoded IBF lost superset mode")
+	}
+	assertSameIBF(t, ibfAlice, &decoded)
+}
+
+func TestSupersetReportsViolation(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+	mapping := &EGHMapping{}
+
+	// Alice holds 5, which Bob lacks.
+	ibfAlice := NewIBF(universeSize, mapping, WithSuperset())
+	ibfBob := NewIBF(universeSize, mapping, WithSuperset())
+	decoder := NewIncrementalDecoder(universeSize, mapping, WithSuperset())
+
+	for i := 0; i < 3; i++ {
+		batchAlice, _ := ibfAlice.AddSymbols(symbolRange(1, 5))
+		batchBob, _ := ibfBob.AddSymbols(symbolRange(1, 4))
+		if err := decoder.AddBatches(batchBob, batchAlice); err != nil {
+			t.Fatalf("AddBatches: %v", err)
+		}
+	}
+
+	if _, err := decoder.Decode(); !errors.Is(err, ErrSupersetViolation) {
+		t.Fatalf("got %v, want ErrSupersetViolation", err)
+	}
+	if _, _, err := ibfBob.Subtract(ibfAlice).DecodeChecked(); !errors.Is(err, ErrSupersetViolation) {
+		t.Fatalf("got %v, want ErrSupersetViolation", err)
+	}
+
+	full := NewIBF(universeSize, mapping)
+	full.AddSymbols(nil)
+	full.AddSymbols(nil)
+	full.AddSymbols(nil)
+	if _, err := ibfBob.SubtractChecked(full); !errors.Is(err, ErrSupersetMismatch) {
+		t.Fatalf("got %v, want ErrSupersetMismatch", err)
+	}
+}
@@ -20,16 +20,50 @@ import (
 type MappingType string
 
 const (
-	EGH MappingType = "egh"
-	OLS MappingType = "ols"
+	EGH             MappingType = "egh"
+	OLS             MappingType = "ols"
+	ExtendedHamming MappingType = "extended_hamming"
 )
 
-// runTrial simulates a reconciliation trial for benchmarking.
+// extendedHammingMaxDiffSize is the largest symmetric difference
+// the Extended Hamming mapping can list.
+const extendedHammingMaxDiffSize = 3
+
+// maxIterations returns the number of iterations the mapping of ibf
+// defines, or math.MaxUint64 for unbounded mappings.
+func maxIterations(ibf *InvertibleBloomFilter) uint64 {
+	if bounded, ok := ibf.MappingMethod.(BoundedMappingMethod); ok {
+		return bounded.MaxIterations()
+	}
+	return math.MaxUint64
+}
+
+// averageDecodedBits returns the average bits transmitted by the
+// trials that decoded the difference, rounded up, and the number of
+// failed trials. Failed trials stop at the last iteration of the
+// mapping, so they are left out rather than skew the average.
+func averageDecodedBits(bits []uint64, decoded []bool) (average uint64, failed int) {
+	var total uint64
+	for i := range bits {
+		if decoded[i] {
+			total += bits[i]
+		} else {
+			failed++
+		}
+	}
+	if failed == len(bits) {
+		return 0, failed
+	}
+	return uint64(math.Ceil(float64(total) / float64(len(bits)-failed))), failed
+}
+
+// runTrial simulates a reconciliation trial for benchmarking, and
+// reports whether the difference was decoded.
 func runTrialTotalBitsVsDiffSize(trialNumber int,
 	universeSize int,
 	symmetricDiffSize int,
 	mappingType MappingType,
-	rng *rand.Rand) uint64 {
+	rng *rand.Rand) (uint64, bool) {
 
 	// For Debugging
 	// rng.Seed(0)
@@ -63,31 +97,41 @@ func runTrialTotalBitsVsDiffSize(trialNumber int,
 		ibfBob = NewIBF(uint256.NewInt(uint64(universeSize)), &EGHMapping{})
 	case OLS:
 		olsMapping := OLSMapping{
-			Order: uint64(math.Ceil(math.Sqrt(float64(universeSize)))),
+			Order: uint256.NewInt(uint64(math.Ceil(math.Sqrt(float64(universeSize))))),
 		}
 		ibfAlice = NewIBF(uint256.NewInt(uint64(universeSize)), &olsMapping)
 		ibfBob = NewIBF(uint256.NewInt(uint64(universeSize)), &olsMapping)
+	case ExtendedHamming:
+		extendedHammingMapping := ExtendedHammingMapping{
+			UniverseSize: uint256.NewInt(uint64(universeSize)),
+		}
+		ibfAlice = NewIBF(uint256.NewInt(uint64(universeSize)), &extendedHammingMapping)
+		ibfBob = NewIBF(uint256.NewInt(uint64(universeSize)), &extendedHammingMapping)
 	}
 
 	transmittedBits := uint64(0)
 
-	for {
-		ibfAlice.AddSymbols(alice)
+	// Bounded mappings may run out of iterations before the
+	// difference decodes, which fails the trial.
+	decoded := false
+	for !decoded && ibfAlice.Iteration < maxIterations(ibfAlice) {
+		if _, err := ibfAlice.AddSymbols(alice); err != nil {
+			panic(err)
+		}
 
 		transmittedBits = ibfAlice.GetTransmittedBitsSize()
 
-		ibfBob.AddSymbols(bob)
+		if _, err := ibfBob.AddSymbols(bob); err != nil {
+			panic(err)
+		}
 
 		ibfDiff := ibfBob.Subtract(ibfAlice)
 		bobWithoutAlice, _, ok := ibfDiff.Decode()
 
-		if ok == false {
-			continue
-		}
-
-		if len(bobWithoutAlice) == symmetricDiffSize {
-			break
-		}
+		decoded = ok && len(bobWithoutAlice) == symmetricDiffSize
+	}
+	if !decoded {
+		log.Printf("Trial %d for %s method failed after %d iterations\n", trialNumber, mappingType, ibfAlice.Iteration)
 	}
 
 	fmt.Printf("Trial %d for %s method, Symmetric Difference len: %d with %d bits\n",
@@ -95,10 +139,10 @@ func runTrialTotalBitsVsDiffSize(trialNumber int,
 	log.Printf("Trial %d for %s method, Symmetric Difference len: %d with %d bits\n",
 		trialNumber, mappingType, symmetricDiffSize, transmittedBits)
 
-	return transmittedBits
+	return transmittedBits, decoded
 }
 
-// BenchmarkReconciliation benchmarks both EGH and OLS methods
+// BenchmarkReconciliation benchmarks the EGH, OLS and Extended Hamming methods
 func BenchmarkTotalBitsVsDiffSize(b *testing.B) {
 	benches := []struct {
 		symmetricDiffSize int
@@ -121,7 +165,7 @@ func BenchmarkTotalBitsVsDiffSize(b *testing.B) {
 	//numTrials := 1
 
 	numTrials := 10
-	mappingTypes := []MappingType{EGH, OLS}
+	mappingTypes := []MappingType{EGH, OLS, ExtendedHamming}
 
 	for _, mappingType := range mappingTypes {
 		// Create a CSV file for each mapping type
@@ -145,6 +189,8 @@ func BenchmarkTotalBitsVsDiffSize(b *testing.B) {
 		var maxSymmetricDiffSize int
 		if mappingType == OLS {
 			maxSymmetricDiffSize = int(math.Ceil(math.Sqrt(float64(universeSize))))
+		} else if mappingType == ExtendedHamming {
+			maxSymmetricDiffSize = extendedHammingMaxDiffSize
 		} else {
 			maxSymmetricDiffSize = benches[len(benches)-1].symmetricDiffSize
 		}
@@ -157,8 +203,8 @@ func BenchmarkTotalBitsVsDiffSize(b *testing.B) {
 			b.Run(fmt.Sprintf("%s_Universe=%d_Diff=%d",
 				mappingType, universeSize, bench.symmetricDiffSize),
 				func(b *testing.B) {
-					results := make(chan uint64, numTrials)
-					var totalBitsTransmitted uint64
+					bits := make([]uint64, numTrials)
+					decoded := make([]bool, numTrials)
 
 					var wg sync.WaitGroup
 					wg.Add(numTrials)
@@ -167,28 +213,26 @@ func BenchmarkTotalBitsVsDiffSize(b *testing.B) {
 						go func(trialNum int) {
 							defer wg.Done()
 							rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(trialNum)))
-							result := runTrialTotalBitsVsDiffSize(
+							bits[trialNum], decoded[trialNum] = runTrialTotalBitsVsDiffSize(
 								trialNum+1,
 								universeSize,
 								bench.symmetricDiffSize,
 								mappingType,
 								rng,
 							)
-							results <- result
 						}(i)
 					}
 
-					go func() {
-						wg.Wait()
-						close(results)
-					}()
+					wg.Wait()
 
-					for result := range results {
-						totalBitsTransmitted += result
+					averageBitsTransmitted, failed := averageDecodedBits(bits, decoded)
+					if failed > 0 {
+						log.Printf("%s, Symmetric Difference len %d: %d of %d trials failed\n",
+							mappingType, bench.symmetricDiffSize, failed, numTrials)
+					}
+					if failed == numTrials {
+						return
 					}
-
-					averageFloatBitsTransmitted := float64(totalBitsTransmitted) / float64(numTrials)
-					averageBitsTransmitted := int(math.Ceil(averageFloatBitsTransmitted))
 
 					writer.Write([]string{
 						fmt.Sprintf("%d", bench.symmetricDiffSize),
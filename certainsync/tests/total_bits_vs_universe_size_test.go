@@ -17,12 +17,13 @@ import (
 	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
 )
 
-// runTrial simulates a reconciliation trial for benchmarking.
+// runTrial simulates a reconciliation trial for benchmarking, and
+// reports whether the difference was decoded.
 func runTrialTotalBitsVsUniverseSize(trialNumber int,
 	universeSize int,
 	symmetricDiffSize int,
 	mappingType MappingType,
-	rng *rand.Rand) uint64 {
+	rng *rand.Rand) (uint64, bool) {
 	// For superset assumption
 	// Bob's set will include all elements from 1 to universeSize.
 	bob := make([]*uint256.Int, 0, universeSize)
@@ -52,32 +53,42 @@ func runTrialTotalBitsVsUniverseSize(trialNumber int,
 		ibfBob = NewIBF(uint256.NewInt(uint64(universeSize)), &EGHMapping{})
 	case OLS:
 		olsMapping := OLSMapping{
-			Order: uint64(math.Ceil(math.Sqrt(float64(universeSize)))),
+			Order: uint256.NewInt(uint64(math.Ceil(math.Sqrt(float64(universeSize))))),
 		}
 		ibfAlice = NewIBF(uint256.NewInt(uint64(universeSize)), &olsMapping)
 		ibfBob = NewIBF(uint256.NewInt(uint64(universeSize)), &olsMapping)
+	case ExtendedHamming:
+		extendedHammingMapping := ExtendedHammingMapping{
+			UniverseSize: uint256.NewInt(uint64(universeSize)),
+		}
+		ibfAlice = NewIBF(uint256.NewInt(uint64(universeSize)), &extendedHammingMapping)
+		ibfBob = NewIBF(uint256.NewInt(uint64(universeSize)), &extendedHammingMapping)
 	}
 
 	cost := uint64(0)
 
-	for {
-		ibfAlice.AddSymbols(alice)
+	// Bounded mappings may run out of iterations before the
+	// difference decodes, which fails the trial.
+	decoded := false
+	for !decoded && ibfAlice.Iteration < maxIterations(ibfAlice) {
+		if _, err := ibfAlice.AddSymbols(alice); err != nil {
+			panic(err)
+		}
 
 		cost = ibfAlice.GetTransmittedBitsSize()
 
-		ibfBob.AddSymbols(bob)
+		if _, err := ibfBob.AddSymbols(bob); err != nil {
+			panic(err)
+		}
 
 		// Subtract the two IBFs and Decode the result to find the differences
 		ibfDiff := ibfBob.Subtract(ibfAlice)
 		bobWithoutAlice, _, ok := ibfDiff.Decode()
 
-		if ok == false {
-			continue
-		}
-
-		if len(bobWithoutAlice) == symmetricDiffSize {
-			break
-		}
+		decoded = ok && len(bobWithoutAlice) == symmetricDiffSize
+	}
+	if !decoded {
+		log.Printf("Trial %d for %s method failed after %d iterations\n", trialNumber, mappingType, ibfAlice.Iteration)
 	}
 
 	fmt.Printf("Trial %d for %s method for CertainSync IBLT, Symmetric Difference len: %d with %d bits", trialNumber, mappingType, symmetricDiffSize, cost)
@@ -86,7 +97,7 @@ func runTrialTotalBitsVsUniverseSize(trialNumber int,
 	log.Printf("Trial %d for %s method for CertainSync IBLT, Symmetric Difference len: %d with %d bits\n", trialNumber, mappingType, symmetricDiffSize, cost)
 
 	// Return number of bits transmitted
-	return cost
+	return cost, decoded
 }
 
 // BenchmarkTotalBitsVsUniverseSize benchmarks the reconciliation
@@ -109,10 +120,14 @@ func BenchmarkTotalBitsVsUniverseSize(b *testing.B) {
 
 	numTrials := 10
 
-	mappingTypes := []MappingType{EGH, OLS}
+	mappingTypes := []MappingType{EGH, OLS, ExtendedHamming}
 
 	for _, mappingType := range mappingTypes {
 		for _, symmetricDiffSize := range symmetricDiffSizes {
+			if mappingType == ExtendedHamming && symmetricDiffSize > extendedHammingMaxDiffSize {
+				continue
+			}
+
 			// Prepare a CSV file to store the results for the current symmetric difference size.
 			filename := fmt.Sprintf("%s_total_bits_vs_universe_size_for_diff_size_%d_set_inside_set.csv", string(mappingType), symmetricDiffSize)
 			filePath := filepath.Join(cwd, "results", filename)
@@ -132,8 +147,8 @@ func BenchmarkTotalBitsVsUniverseSize(b *testing.B) {
 			b.Run(fmt.Sprintf("MappingType=%s_DiffSize=%d", mappingType, symmetricDiffSize),
 				func(b *testing.B) {
 					for _, universeSize := range universeSizes {
-						results := make(chan uint64, numTrials)
-						var totalBitsTransmitted uint64
+						bits := make([]uint64, numTrials)
+						decoded := make([]bool, numTrials)
 
 						var wg sync.WaitGroup
 						wg.Add(numTrials)
@@ -143,25 +158,22 @@ func BenchmarkTotalBitsVsUniverseSize(b *testing.B) {
 							go func(trialNum int) {
 								defer wg.Done()
 								rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(trialNum)))
-								result := runTrialTotalBitsVsUniverseSize(
+								bits[trialNum], decoded[trialNum] = runTrialTotalBitsVsUniverseSize(
 									trialNum+1, universeSize, symmetricDiffSize, mappingType, rng)
-								results <- result
 							}(i)
 						}
 
-						// Close results channel when all goroutines are done
-						go func() {
-							wg.Wait()
-							close(results)
-						}()
+						wg.Wait()
 
-						// Collect results
-						for result := range results {
-							totalBitsTransmitted += result
+						// Only trials that decoded count towards the average.
+						averageBitsTransmitted, failed := averageDecodedBits(bits, decoded)
+						if failed > 0 {
+							log.Printf("%s, Universe Size %d: %d of %d trials failed\n",
+								mappingType, universeSize, failed, numTrials)
+						}
+						if failed == numTrials {
+							continue
 						}
-
-						averageFloatBitsTransmitted := float64(totalBitsTransmitted) / float64(numTrials)
-						averageBitsTransmitted := int(math.Ceil(averageFloatBitsTransmitted))
 
 						// Write the result to the CSV file
 						writer.Write([]string{
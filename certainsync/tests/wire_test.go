@@ -0,0 +1,252 @@
+package certainsync_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/holiman/uint256"
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+)
+
+// symbolRange returns the symbols from..to (inclusive).
+func symbolRange(from, to uint64) []*uint256.Int {
+	symbols := make([]*uint256.Int, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		symbols = append(symbols, uint256.NewInt(i))
+	}
+	return symbols
+}
+
+// assertSameIBF fails the test if the two IBFs differ.
+func assertSameIBF(t *testing.T, want, got *InvertibleBloomFilter) {
+	t.Helper()
+
+	if got.Iteration != want.Iteration || got.Size != want.Size {
+		t.Fatalf("got iteration %d size %d, want iteration %d size %d",
+			got.Iteration, got.Size, want.Iteration, want.Size)
+	}
+	if !got.UniverseSize.Eq(want.UniverseSize) {
+		t.Fatalf("got universe %s, want %s", got.UniverseSize.Dec(), want.UniverseSize.Dec())
+	}
+	for j := uint64(0); j < want.Size; j++ {
+		w, g := want.Cells[j], got.Cells[j]
+		if w != g {
+			t.Fatalf("cell %d differs: got %+v, want %+v", j, g, w)
+		}
+	}
+}
+
+func TestMarshalBinaryRoundTrip(t *testing.T) {
+	universes := []*uint256.Int{
+		uint256.NewInt(1000),
+		new(uint256.Int).SetAllOne(),
+	}
+	mappings := []MappingMethod{
+		&EGHMapping{},
+		&OLSMapping{Order: uint256.NewInt(32)},
+		&ExtendedHammingMapping{UniverseSize: uint256.NewInt(1000)},
+		&OLSMapping{Order: OLSOrderForUniverse(new(uint256.Int).SetAllOne()), Cells: 50},
+		&OLSMapping{},
+	}
+
+	for _, universeSize := range universes {
+		for _, mapping := range mappings {
+			ibf := NewIBF(universeSize, mapping)
+			for i := 0; i < 4; i++ {
+				ibf.AddSymbols(symbolRange(1, 900))
+			}
+
+			data, err := ibf.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+
+			var decoded InvertibleBloomFilter
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			assertSameIBF(t, ibf, &decoded)
+
+			// The cells on the wire should cost exactly what the
+			// benchmarks account for, padded to a byte. The empty
+			// IBF encodes its iteration and size as one byte each.
+			empty, err := NewIBF(universeSize, mapping).MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			headerLen := len(empty) - 2 + uvarintLen(ibf.Iteration) + uvarintLen(ibf.Size)
+			cellBytes := uint64(len(data) - headerLen)
+			if accounted := ibf.GetTransmittedBitsSize(); cellBytes != (accounted+7)/8 {
+				t.Fatalf("cells use %d bytes on the wire, accounted %d bits", cellBytes, accounted)
+			}
+		}
+	}
+}
+
+func TestEncoderDecoderStream(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	ibfs := make([]*InvertibleBloomFilter, 0)
+	ibf := NewIBF(uint256.NewInt(500), &EGHMapping{})
+	for i := 0; i < 3; i++ {
+		ibf.AddSymbols(symbolRange(1, 100))
+		if err := enc.Encode(ibf); err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		snapshot := NewIBF(ibf.UniverseSize, ibf.MappingMethod)
+		snapshot.Copy(ibf)
+		ibfs = append(ibfs, snapshot)
+	}
+
+	dec := NewDecoder(&buf)
+	for _, want := range ibfs {
+		var got InvertibleBloomFilter
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		assertSameIBF(t, want, &got)
+	}
+}
+
+func TestOLSDescriptorDescribesFoldedCells(t *testing.T) {
+	universeSize := uint256.NewInt(1000)
+	same := [][2]*OLSMapping{
+		// Cells does not change unfolded squares.
+		{{Order: uint256.NewInt(32)}, {Order: uint256.NewInt(32), Cells: 5}},
+		// Folded squares have 1024 cells by default.
+		{{Order: new(uint256.Int).Lsh(uint256.NewInt(1), 128)}, {Order: new(uint256.Int).Lsh(uint256.NewInt(1), 128), Cells: 1024}},
+	}
+	for _, pair := range same {
+		a, b := NewIBF(universeSize, pair[0]), NewIBF(universeSize, pair[1])
+		a.AddSymbols(symbolRange(1, 100))
+		b.AddSymbols(symbolRange(1, 90))
+		if _, err := a.SubtractChecked(b); err != nil {
+			t.Fatalf("SubtractChecked: %v", err)
+		}
+	}
+
+	for _, params := range [][]byte{
+		// Cells of unfolded squares.
+		{1, 32, 5},
+		// Zero cells of folded squares.
+		append([]byte{17, 1}, append(make([]byte, 16), 0)...),
+		// No cells for folded squares.
+		append([]byte{17, 1}, make([]byte, 16)...),
+	} {
+		d := MappingDescriptor{Name: OLSMappingName, Params: params}
+		if _, err := d.NewMapping(); !errors.Is(err, ErrMalformedIBF) {
+			t.Fatalf("params %v: got %v, want ErrMalformedIBF", params, err)
+		}
+	}
+}
+
+func TestUnmarshalBinaryRejectsBadInput(t *testing.T) {
+	ibf := NewIBF(uint256.NewInt(500), &EGHMapping{})
+	ibf.AddSymbols(symbolRange(1, 100))
+
+	data, err := ibf.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	var decoded InvertibleBloomFilter
+
+	badVersion := append([]byte{}, data...)
+	badVersion[0] = WireFormatVersion + 1
+	if err := decoded.UnmarshalBinary(badVersion); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("got %v, want ErrUnsupportedVersion", err)
+	}
+
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); !errors.Is(err, ErrMalformedIBF) {
+		t.Fatalf("got %v, want ErrMalformedIBF", err)
+	}
+
+	if err := decoded.UnmarshalBinary(append(data, 0)); !errors.Is(err, ErrMalformedIBF) {
+		t.Fatalf("got %v, want ErrMalformedIBF", err)
+	}
+}
+
+func TestUnmarshalBinaryRejectsBadIterations(t *testing.T) {
+	tests := []struct {
+		name      string
+		mapping   MappingMethod
+		iteration uint64
+		size      uint64
+	}{
+		// EGH has 2+3+5 cells after three iterations.
+		{"TooFewCells", &EGHMapping{}, 3, 3},
+		{"TooManyCells", &EGHMapping{}, 1, 3},
+		// OLS of order 5 defines 6 iterations of 5 cells.
+		{"PastMaxIterations", &OLSMapping{Order: uint256.NewInt(5)}, 7, 35},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ibf := NewIBF(uint256.NewInt(25), tt.mapping)
+			ibf.Iteration, ibf.Size = tt.iteration, tt.size
+			ibf.Cells = make([]IBFCell, tt.size)
+
+			data, err := ibf.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			var decoded InvertibleBloomFilter
+			if err := decoded.UnmarshalBinary(data); !errors.Is(err, ErrMalformedIBF) {
+				t.Fatalf("got %v, want ErrMalformedIBF", err)
+			}
+		})
+	}
+}
+
+func TestDecodeRejectsMissingCells(t *testing.T) {
+	// Symbol 5 is mapped to cell 2 of the second iteration, which
+	// only has one of its three cells.
+	ibf := NewIBF(uint256.NewInt(100), &EGHMapping{})
+	ibf.AddSymbols(symbolRange(5, 5))
+	ibf.Cells = append(ibf.Cells[:ibf.Size], IBFCell{})
+	ibf.Iteration, ibf.Size = 3, 3
+
+	if _, _, err := ibf.DecodeChecked(); !errors.Is(err, ErrMalformedIBF) {
+		t.Fatalf("got %v, want ErrMalformedIBF", err)
+	}
+}
+
+// uvarintLen returns the encoded length of x as a uvarint.
+func uvarintLen(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+func TestEncodeBatchRoundTrip(t *testing.T) {
+	for _, opts := range [][]IBFOption{nil, {WithSuperset()}, {WithCountBits(7), WithHashSumBits(13)}} {
+		ibf := NewIBF(uint256.NewInt(1000), &EGHMapping{}, opts...)
+		ibf.AddSymbols(symbolRange(1, 300))
+		batch, _ := ibf.AddSymbols(symbolRange(1, 300))
+
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).EncodeBatch(batch, ibf.Layout); err != nil {
+			t.Fatalf("EncodeBatch: %v", err)
+		}
+		got, err := NewDecoder(&buf).DecodeBatch(ibf.Layout, ibf.Superset)
+		if err != nil {
+			t.Fatalf("DecodeBatch: %v", err)
+		}
+
+		if got.Iteration != batch.Iteration || got.Offset != batch.Offset ||
+			got.Superset != batch.Superset || len(got.Cells) != len(batch.Cells) {
+			t.Fatalf("got batch %d at %d with %d cells, want %d at %d with %d cells",
+				got.Iteration, got.Offset, len(got.Cells), batch.Iteration, batch.Offset, len(batch.Cells))
+		}
+		for j := range batch.Cells {
+			if got.Cells[j] != batch.Cells[j] {
+				t.Fatalf("cell %d differs: got %+v, want %+v", j, got.Cells[j], batch.Cells[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,615 @@
+package certainsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/holiman/uint256"
+)
+
+// WireFormatVersion is the version byte written at the start
+// of every encoded IBF.
+const WireFormatVersion uint8 = 1
+
+// Mapping method names used by mapping descriptors.
+const (
+	EGHMappingName             = "egh"
+	OLSMappingName             = "ols"
+	ExtendedHammingMappingName = "extended_hamming"
+)
+
+// wireFlagSuperset marks the IBF as superset in the header flags.
+const wireFlagSuperset byte = 1 << 0
+
+// maxWireStringLen bounds names and parameter blobs read from the wire.
+const maxWireStringLen = 1 << 10
+
+// Wire format errors
+var (
+	ErrUnsupportedVersion = errors.New("unsupported wire format version")
+	ErrUnknownMapping     = errors.New("unknown mapping method")
+	ErrUnknownHasher      = errors.New("unknown cell hasher")
+	ErrMissingHasherKey   = errors.New("keyed cell hasher needs the session seed")
+	ErrMalformedIBF       = errors.New("malformed IBF encoding")
+)
+
+// MappingDescriptor identifies a mapping method and its
+// parameters independently of its Go type.
+type MappingDescriptor struct {
+	Name   string
+	Params []byte
+}
+
+// DescribeMapping returns the descriptor of a mapping method.
+func DescribeMapping(m MappingMethod) (MappingDescriptor, error) {
+	switch mapping := m.(type) {
+	case *EGHMapping:
+		return MappingDescriptor{Name: EGHMappingName}, nil
+	case *OLSMapping:
+		// Order, empty for a nil order, followed by the number of
+		// cells if the squares are folded, so that Cells is only
+		// described where it changes the mapping.
+		var params []byte
+		if mapping.Order != nil {
+			params = appendWireString(params, mapping.Order.Bytes())
+		} else {
+			params = appendWireString(params, nil)
+		}
+		if mapping.Folded() {
+			params = binary.AppendUvarint(params, mapping.GetAdditionalCellsCount(1))
+		}
+		return MappingDescriptor{Name: OLSMappingName, Params: params}, nil
+	case *ExtendedHammingMapping:
+		// A nil universe size is described by empty parameters.
+		var params []byte
+		if mapping.UniverseSize != nil {
+			params = mapping.UniverseSize.Bytes()
+			if len(params) == 0 {
+				params = []byte{0}
+			}
+		}
+		return MappingDescriptor{Name: ExtendedHammingMappingName, Params: params}, nil
+	default:
+		return MappingDescriptor{}, fmt.Errorf("%w: %T", ErrUnknownMapping, m)
+	}
+}
+
+// NewMapping creates the mapping method described by the descriptor.
+func (d MappingDescriptor) NewMapping() (MappingMethod, error) {
+	switch d.Name {
+	case EGHMappingName:
+		if len(d.Params) != 0 {
+			return nil, fmt.Errorf("%w: unexpected %s parameters", ErrMalformedIBF, d.Name)
+		}
+		return &EGHMapping{}, nil
+	case OLSMappingName:
+		r := bufio.NewReader(bytes.NewReader(d.Params))
+		orderBytes, err := readWireString(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(orderBytes) > 32 {
+			return nil, fmt.Errorf("%w: %s order too large", ErrMalformedIBF, d.Name)
+		}
+		mapping := &OLSMapping{}
+		if len(orderBytes) != 0 {
+			mapping.Order = new(uint256.Int).SetBytes(orderBytes)
+		}
+		if r.Buffered() != 0 {
+			if mapping.Cells, err = binary.ReadUvarint(r); err != nil {
+				return nil, wireReadErr(err)
+			}
+			if mapping.Cells == 0 || !mapping.Folded() {
+				return nil, fmt.Errorf("%w: %d %s cells for unfolded squares", ErrMalformedIBF, mapping.Cells, d.Name)
+			}
+		} else if mapping.Folded() {
+			return nil, fmt.Errorf("%w: %s cells missing for folded squares", ErrMalformedIBF, d.Name)
+		}
+		if r.Buffered() != 0 {
+			return nil, fmt.Errorf("%w: trailing %s parameters", ErrMalformedIBF, d.Name)
+		}
+		return mapping, nil
+	case ExtendedHammingMappingName:
+		if len(d.Params) > 32 {
+			return nil, fmt.Errorf("%w: %s universe size too large", ErrMalformedIBF, d.Name)
+		}
+		if len(d.Params) == 0 {
+			return &ExtendedHammingMapping{}, nil
+		}
+		return &ExtendedHammingMapping{UniverseSize: new(uint256.Int).SetBytes(d.Params)}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownMapping, d.Name)
+	}
+}
+
+// hasherName returns the wire name of a registered cell hasher.
+func hasherName(h CellHasher) (string, error) {
+	if h == nil {
+		return "", fmt.Errorf("%w: nil", ErrUnknownHasher)
+	}
+
+	hasherRegistryMu.RLock()
+	_, ok := hasherRegistry[h.Name()]
+	hasherRegistryMu.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("%w: %q (%T)", ErrUnknownHasher, h.Name(), h)
+	}
+	return h.Name(), nil
+}
+
+// Encoder writes IBFs to an output stream.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the binary encoding of ibf to the stream.
+// The encoding is a version byte, a header with the universe size,
+// mapping descriptor, hasher name, flags, cell layout, iteration count
+// and number of cells, followed by the cells. Each cell field is
+// written in as many bits as the layout gives it, with the cells
+// packed together and padded to a byte at the end.
+func (e *Encoder) Encode(ibf *InvertibleBloomFilter) error {
+	if ibf == nil {
+		return ErrNilIBF
+	}
+
+	descriptor, err := DescribeMapping(ibf.MappingMethod)
+	if err != nil {
+		return err
+	}
+
+	name, err := hasherName(ibf.Hasher)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 0, 64)
+	buf = append(buf, WireFormatVersion)
+	universe := ibf.UniverseSize.Bytes32()
+	buf = append(buf, universe[:]...)
+	buf = appendWireString(buf, []byte(descriptor.Name))
+	buf = appendWireString(buf, descriptor.Params)
+	buf = appendWireString(buf, []byte(name))
+	var flags byte
+	if ibf.Superset {
+		flags |= wireFlagSuperset
+	}
+	buf = append(buf, flags)
+	buf = binary.AppendUvarint(buf, uint64(ibf.Layout.CountBits))
+	buf = binary.AppendUvarint(buf, uint64(ibf.Layout.XorSumBits))
+	buf = binary.AppendUvarint(buf, uint64(ibf.Layout.HashSumBits))
+	buf = binary.AppendUvarint(buf, ibf.Iteration)
+	buf = binary.AppendUvarint(buf, ibf.Size)
+
+	w := bufio.NewWriter(e.w)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	if err := checkLayout(ibf.Layout, ibf.Hasher); err != nil {
+		return err
+	}
+
+	bw := &bitWriter{w: w}
+	for j := uint64(0); j < ibf.Size; j++ {
+		if err := putCell(bw, &ibf.Cells[j], ibf.Layout, ibf.Superset); err != nil {
+			return fmt.Errorf("cell %d: %w", j, err)
+		}
+	}
+	if err := bw.flush(); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// Decoder reads IBFs from an input stream.
+type Decoder struct {
+	r *bufio.Reader
+}
+
+// NewDecoder returns a new decoder that reads from r.
+// The decoder may buffer data read from r.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// Decode reads the next encoded IBF from the stream into ibf,
+// replacing its previous contents. The hasher of ibf is kept if
+// it matches the encoded hasher name. Keys of keyed hashers are not
+// encoded, so ibf must already have its keyed hasher.
+func (d *Decoder) Decode(ibf *InvertibleBloomFilter) error {
+	if ibf == nil {
+		return ErrNilIBF
+	}
+
+	version, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != WireFormatVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	var universe [32]byte
+	if _, err := io.ReadFull(d.r, universe[:]); err != nil {
+		return wireReadErr(err)
+	}
+	universeSize := new(uint256.Int).SetBytes32(universe[:])
+
+	var descriptor MappingDescriptor
+	mappingName, err := readWireString(d.r)
+	if err != nil {
+		return err
+	}
+	descriptor.Name = string(mappingName)
+	if descriptor.Params, err = readWireString(d.r); err != nil {
+		return err
+	}
+	mapping, err := descriptor.NewMapping()
+	if err != nil {
+		return err
+	}
+
+	name, err := readWireString(d.r)
+	if err != nil {
+		return err
+	}
+	hasher := ibf.Hasher
+	if currentName, err := hasherName(hasher); err != nil || currentName != string(name) {
+		// The keys of keyed hashers never go on the wire.
+		if hasher, err = NewHasher(string(name), nil); err != nil {
+			return err
+		}
+	}
+
+	flags, err := d.r.ReadByte()
+	if err != nil {
+		return wireReadErr(err)
+	}
+	if flags&^wireFlagSuperset != 0 {
+		return fmt.Errorf("%w: unknown flags %#x", ErrMalformedIBF, flags)
+	}
+	superset := flags&wireFlagSuperset != 0
+
+	var layout CellLayout
+	for _, width := range []*uint{&layout.CountBits, &layout.XorSumBits, &layout.HashSumBits} {
+		bits, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return wireReadErr(err)
+		}
+		if bits > math.MaxUint16 {
+			return fmt.Errorf("%w: field of %d bits", ErrMalformedIBF, bits)
+		}
+		*width = uint(bits)
+	}
+	if err := checkLayout(layout, hasher); err != nil {
+		return err
+	}
+
+	iteration, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return wireReadErr(err)
+	}
+	size, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return wireReadErr(err)
+	}
+
+	// Grow the cells as they arrive so a bogus size cannot force
+	// a huge allocation up front.
+	cells := make([]IBFCell, 0)
+	br := &bitReader{r: d.r}
+	for j := uint64(0); j < size; j++ {
+		c, err := getCell(br, layout, superset)
+		if err != nil {
+			return err
+		}
+		cells = append(cells, c)
+	}
+
+	// Checked once the cells are read, which bounds the iterations
+	// to check by the size of the input.
+	if err := checkIterations(mapping, iteration, size); err != nil {
+		return err
+	}
+
+	ibf.Cells = cells
+	ibf.UniverseSize = universeSize
+	ibf.Iteration = iteration
+	ibf.Size = size
+	ibf.MappingMethod = mapping
+	ibf.Hasher = hasher
+	ibf.Superset = superset
+	ibf.Layout = layout
+
+	return nil
+}
+
+// checkIterations checks that an IBF with the given mapping method
+// can have the given number of iterations and cells.
+func checkIterations(mapping MappingMethod, iteration, size uint64) error {
+	if bounded, ok := mapping.(BoundedMappingMethod); ok && iteration > bounded.MaxIterations() {
+		return fmt.Errorf("%w: %d iterations, %T defines %d",
+			ErrMalformedIBF, iteration, mapping, bounded.MaxIterations())
+	}
+
+	cells := uint64(0)
+	for i := uint64(1); i <= iteration && cells <= size; i++ {
+		cells += mapping.GetAdditionalCellsCount(i)
+	}
+	if cells != size {
+		return fmt.Errorf("%w: %d cells, %d iterations of %T have %d or more",
+			ErrMalformedIBF, size, iteration, mapping, cells)
+	}
+	return nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (ibf *InvertibleBloomFilter) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(ibf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (ibf *InvertibleBloomFilter) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	dec := NewDecoder(r)
+	if err := dec.Decode(ibf); err != nil {
+		return err
+	}
+	if trailing := r.Len() + dec.r.Buffered(); trailing != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrMalformedIBF, trailing)
+	}
+	return nil
+}
+
+// EncodeBatch writes the cells of a batch laid out with l, for peers
+// that already know the header of the IBF. The encoding is the
+// iteration, offset and number of cells as uvarints, followed by the
+// cells packed as by Encode.
+func (e *Encoder) EncodeBatch(batch CellBatch, l CellLayout) error {
+	buf := make([]byte, 0, 3*binary.MaxVarintLen64)
+	buf = binary.AppendUvarint(buf, batch.Iteration)
+	buf = binary.AppendUvarint(buf, batch.Offset)
+	buf = binary.AppendUvarint(buf, uint64(len(batch.Cells)))
+
+	w := bufio.NewWriter(e.w)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	bw := &bitWriter{w: w}
+	for j := range batch.Cells {
+		if err := putCell(bw, &batch.Cells[j], l, batch.Superset); err != nil {
+			return fmt.Errorf("cell %d: %w", j, err)
+		}
+	}
+	if err := bw.flush(); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// DecodeBatch reads a batch written by EncodeBatch with the same
+// layout and superset mode.
+func (d *Decoder) DecodeBatch(l CellLayout, superset bool) (CellBatch, error) {
+	batch := CellBatch{Superset: superset}
+
+	var err error
+	if batch.Iteration, err = binary.ReadUvarint(d.r); err != nil {
+		return batch, wireReadErr(err)
+	}
+	if batch.Offset, err = binary.ReadUvarint(d.r); err != nil {
+		return batch, wireReadErr(err)
+	}
+	size, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return batch, wireReadErr(err)
+	}
+
+	br := &bitReader{r: d.r}
+	for j := uint64(0); j < size; j++ {
+		c, err := getCell(br, l, superset)
+		if err != nil {
+			return batch, err
+		}
+		batch.Cells = append(batch.Cells, c)
+	}
+
+	return batch, nil
+}
+
+// putCell writes a cell with the widths of layout l. Superset cells
+// have no HashSum.
+func putCell(bw *bitWriter, c *IBFCell, l CellLayout, superset bool) error {
+	if err := bw.writeBits(uint64(c.Count), l.CountBits); err != nil {
+		return err
+	}
+	if err := bw.writeWide(&c.XorSum, l.XorSumBits); err != nil {
+		return fmt.Errorf("XorSum: %w", err)
+	}
+	if superset {
+		return nil
+	}
+	if err := bw.writeWide(&c.HashSum, l.HashSumBits); err != nil {
+		return fmt.Errorf("HashSum: %w", err)
+	}
+	return nil
+}
+
+// getCell reads a cell written by putCell.
+func getCell(br *bitReader, l CellLayout, superset bool) (IBFCell, error) {
+	var c IBFCell
+
+	count, err := br.readBits(l.CountBits)
+	if err != nil {
+		return c, err
+	}
+	c.Count = l.wrapCount(int64(count))
+
+	if err = br.readWide(&c.XorSum, l.XorSumBits); err != nil {
+		return c, err
+	}
+	if !superset {
+		if err = br.readWide(&c.HashSum, l.HashSumBits); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// bitWriter writes fields of any width in bits, most significant bit
+// first, with no padding between them.
+type bitWriter struct {
+	w   *bufio.Writer
+	cur byte // Pending bits, in the low n bits
+	n   uint
+}
+
+// writeBits writes the low n bits of v, n <= 64.
+func (bw *bitWriter) writeBits(v uint64, n uint) error {
+	for n > 0 {
+		k := min(n, 8-bw.n)
+		n -= k
+		bw.cur = bw.cur<<k | byte(v>>n)&(1<<k-1)
+		bw.n += k
+
+		if bw.n == 8 {
+			if err := bw.w.WriteByte(bw.cur); err != nil {
+				return err
+			}
+			bw.cur, bw.n = 0, 0
+		}
+	}
+	return nil
+}
+
+// writeWide writes x in n bits, n <= 256.
+func (bw *bitWriter) writeWide(x *uint256.Int, n uint) error {
+	if uint(x.BitLen()) > n {
+		return fmt.Errorf("%w: value needs %d bits, field has %d",
+			ErrMalformedIBF, x.BitLen(), n)
+	}
+	for i := 3; i >= 0; i-- {
+		if low := uint(64 * i); n > low {
+			if err := bw.writeBits(x[i], min(n-low, 64)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flush writes the pending bits, padded with zeros to a byte.
+func (bw *bitWriter) flush() error {
+	if bw.n == 0 {
+		return nil
+	}
+	err := bw.w.WriteByte(bw.cur << (8 - bw.n))
+	bw.cur, bw.n = 0, 0
+	return err
+}
+
+// bitReader reads fields written by a bitWriter.
+type bitReader struct {
+	r   *bufio.Reader
+	cur byte // Unread bits, in the low n bits
+	n   uint
+}
+
+// readBits reads n bits, n <= 64.
+func (br *bitReader) readBits(n uint) (uint64, error) {
+	var v uint64
+	for n > 0 {
+		if br.n == 0 {
+			b, err := br.r.ReadByte()
+			if err != nil {
+				return 0, wireReadErr(err)
+			}
+			br.cur, br.n = b, 8
+		}
+
+		k := min(n, br.n)
+		n -= k
+		br.n -= k
+		v = v<<k | uint64(br.cur>>br.n)&(1<<k-1)
+	}
+	return v, nil
+}
+
+// readWide reads a value of n bits into x, n <= 256.
+func (br *bitReader) readWide(x *uint256.Int, n uint) error {
+	x.Clear()
+	for i := 3; i >= 0; i-- {
+		if low := uint(64 * i); n > low {
+			limb, err := br.readBits(min(n-low, 64))
+			if err != nil {
+				return err
+			}
+			x[i] = limb
+		}
+	}
+	return nil
+}
+
+// checkLayout checks that the widths of a cell layout can be written
+// and that h computes hashes wide enough for its HashSum.
+func checkLayout(l CellLayout, h CellHasher) error {
+	if l.CountBits == 0 || l.CountBits > maxCountBits ||
+		l.XorSumBits == 0 || l.XorSumBits > 256 ||
+		l.HashSumBits == 0 || l.HashSumBits > h.Bits() {
+		return fmt.Errorf("%w: invalid cell layout %+v", ErrMalformedIBF, l)
+	}
+	return nil
+}
+
+// appendWireString appends a uvarint length-prefixed byte string.
+func appendWireString(buf, s []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// readWireString reads a byte string written by appendWireString.
+func readWireString(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, wireReadErr(err)
+	}
+	if n > maxWireStringLen {
+		return nil, fmt.Errorf("%w: string of %d bytes", ErrMalformedIBF, n)
+	}
+	s := make([]byte, n)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return nil, wireReadErr(err)
+	}
+	return s, nil
+}
+
+// wireReadErr reports a stream that ended inside an encoded IBF
+// as malformed.
+func wireReadErr(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v", ErrMalformedIBF, io.ErrUnexpectedEOF)
+	}
+	return err
+}
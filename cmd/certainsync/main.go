@@ -0,0 +1,282 @@
+// Command certainsync reconciles two sets of numbers held by two
+// processes over TCP with rateless CertainSync.
+//
+// Usage:
+//
+//	certainsync serve -set FILE [-listen ADDR] [-mappings LIST] [-timeout D] [-max-cells N] [-once] [-o FILE]
+//	certainsync sync -set FILE -connect ADDR [-mapping egh|ols] [-universe N] [-timeout D] [-o FILE]
+//
+// serve waits for peers and decodes the difference with each of them,
+// one session at a time. sync connects to a server and streams the
+// cells of its set, built with the given mapping method, until the
+// server has decoded the difference. OLS over large universes, such
+// as the default one, is folded into about sqrt(n) cells per iteration
+// for a set of n elements, see OLSMapping. A server started with -mappings
+// only accepts the listed mapping methods, and proposes EGH to peers
+// using another one. Sessions that take longer than -timeout, or that
+// would grow the server's IBF past -max-cells, end with the part of the
+// difference decoded so far, as do sessions interrupted with SIGINT,
+// after which serve exits.
+//
+// Set files hold one element per line, in decimal or 0x-prefixed hex.
+// Blank lines and lines starting with # are ignored. Both commands
+// print the difference as one element per line: +x for an element
+// only the peer has, -x for an element only the local set has. Unless
+// started with -once, serve precedes the difference with each peer by
+// a "# peer ADDR" line, and appends the differences to the -o file.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/holiman/uint256"
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+	"github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync/session"
+)
+
+const usage = `usage:
+  certainsync serve -set FILE [-listen ADDR] [-mappings LIST] [-timeout D] [-max-cells N] [-once] [-o FILE]
+  certainsync sync -set FILE -connect ADDR [-mapping egh|ols] [-universe N] [-timeout D] [-o FILE]`
+
+// dialTimeout bounds the time sync waits to connect to the server.
+const dialTimeout = 10 * time.Second
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "certainsync:", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the subcommand named by args[0], until ctx is cancelled.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, usage)
+		return flag.ErrHelp
+	}
+
+	switch args[0] {
+	case "serve":
+		return serveCommand(ctx, args[1:], stdout, stderr)
+	case "sync":
+		return syncCommand(ctx, args[1:], stdout, stderr)
+	default:
+		fmt.Fprintln(stderr, usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// serveCommand parses the flags of serve and serves sessions.
+func serveCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	setFile := fs.String("set", "", "file of the local set")
+	listen := fs.String("listen", "localhost:7600", "TCP address to listen on")
+	mappings := fs.String("mappings", "", "comma-separated mapping methods to accept (default all)")
+	timeout := fs.Duration("timeout", time.Minute, "maximum duration of a session, 0 for none")
+	maxCells := fs.Uint64("max-cells", 1<<24, "maximum number of cells of a session, 0 for none")
+	once := fs.Bool("once", false, "exit after the first session")
+	outFile := fs.String("o", "", "file to write the differences to, one after the other (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *setFile == "" {
+		return errors.New("serve: -set is required")
+	}
+
+	set, err := readSetFile(*setFile)
+	if err != nil {
+		return err
+	}
+
+	var opts []session.ReceiverOption
+	if *mappings != "" {
+		names := strings.Split(*mappings, ",")
+		for _, name := range names {
+			if _, err := newMapping(name, uint256.NewInt(1), 0); err != nil {
+				return fmt.Errorf("serve: -mappings: %w", err)
+			}
+		}
+		opts = append(opts, session.AcceptMappings(names...))
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	fmt.Fprintf(stderr, "listening on %s\n", ln.Addr())
+
+	receiver := session.NewReceiver(set, opts...)
+	receiver.Limits = session.Limits{Timeout: *timeout, MaxCells: *maxCells}
+	return serve(ctx, ln, receiver, *once, *outFile, stdout, stderr)
+}
+
+// serve runs a session of receiver with each peer that connects to ln,
+// and writes the difference with the peer to outFile, or stdout if
+// outFile is empty. Unless once is set, each difference follows a
+// comment line naming its peer, and the differences after the first
+// are appended to outFile. Failed sessions are reported on stderr,
+// unless once is set, in which case serve returns after the first session.
+// Once ctx is cancelled, serve closes ln and returns nil, after writing
+// the partial difference of the session in progress.
+func serve(ctx context.Context, ln net.Listener, receiver *session.Receiver, once bool, outFile string, stdout, stderr io.Writer) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	written := false
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		result, err := receiver.Run(ctx, conn)
+		conn.Close()
+		report(stderr, conn.RemoteAddr().String(), result, err)
+
+		if hasDiff(result, err) {
+			peer := ""
+			if !once {
+				peer = conn.RemoteAddr().String()
+			}
+			if werr := writeDiff(outFile, written, stdout, peer, result); werr != nil {
+				return werr
+			}
+			written = true
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if once {
+			return err
+		}
+	}
+}
+
+// syncCommand parses the flags of sync and runs a session.
+func syncCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	setFile := fs.String("set", "", "file of the local set")
+	connect := fs.String("connect", "localhost:7600", "TCP address of the server")
+	mappingName := fs.String("mapping", "egh", "mapping method, egh or ols")
+	universe := fs.String("universe", "", "universe size, in decimal or 0x hex (default 2^256-1)")
+	timeout := fs.Duration("timeout", time.Minute, "maximum duration of the session, 0 for none")
+	outFile := fs.String("o", "", "file to write the difference to (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *setFile == "" {
+		return errors.New("sync: -set is required")
+	}
+
+	set, err := readSetFile(*setFile)
+	if err != nil {
+		return err
+	}
+
+	universeSize := new(uint256.Int).SetAllOne()
+	if *universe != "" {
+		if universeSize, err = parseElement(*universe); err != nil {
+			return fmt.Errorf("sync: -universe: %w", err)
+		}
+	}
+	for _, s := range set {
+		if s.IsZero() || s.Gt(universeSize) {
+			return fmt.Errorf("sync: element %s is outside the universe [1, %s]", s.Dec(), universeSize.Dec())
+		}
+	}
+
+	mapping, err := newMapping(*mappingName, universeSize, len(set))
+	if err != nil {
+		return err
+	}
+	if ols, ok := mapping.(*OLSMapping); ok && ols.Folded() {
+		fmt.Fprintf(stderr, "ols: order %s folded into %d cells per iteration\n",
+			ols.Order.Dec(), ols.GetAdditionalCellsCount(1))
+	}
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", *connect)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sender := session.NewSender(set, universeSize, mapping)
+	sender.Limits.Timeout = *timeout
+	result, err := sender.Run(ctx, conn)
+	report(stderr, conn.RemoteAddr().String(), result, err)
+	if hasDiff(result, err) {
+		if werr := writeDiff(*outFile, false, stdout, "", result); werr != nil {
+			return werr
+		}
+	}
+	return err
+}
+
+// newMapping returns the mapping method with the given name. Folded
+// OLS squares get about sqrt(setSize) cells per iteration, as for the
+// txpool simulation.
+func newMapping(name string, universeSize *uint256.Int, setSize int) (MappingMethod, error) {
+	switch name {
+	case EGHMappingName:
+		return &EGHMapping{}, nil
+	case OLSMappingName:
+		return &OLSMapping{
+			Order: OLSOrderForUniverse(universeSize),
+			Cells: uint64(math.Ceil(math.Sqrt(float64(max(setSize, 1))))),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported mapping %q, want %s or %s", name, EGHMappingName, OLSMappingName)
+	}
+}
+
+// hasDiff reports whether a session that returned err has a
+// difference to write, possibly a partial one.
+func hasDiff(result *session.Result, err error) bool {
+	return result != nil && (err == nil || errors.Is(err, session.ErrIncomplete) ||
+		errors.Is(err, session.ErrDeadline) || errors.Is(err, context.Canceled))
+}
+
+// report writes a summary of a session with peer to w.
+func report(w io.Writer, peer string, result *session.Result, err error) {
+	if result == nil {
+		result = &session.Result{}
+	}
+	status := "done"
+	if err != nil {
+		status = err.Error()
+	}
+	mapping := result.Params.Mapping.Name
+	if mapping == "" {
+		mapping = "none agreed"
+	} else if m, err := result.Params.Mapping.NewMapping(); err == nil {
+		if ols, ok := m.(*OLSMapping); ok && ols.Folded() {
+			mapping = fmt.Sprintf("%s folded into %d cells", mapping, ols.GetAdditionalCellsCount(1))
+		}
+	}
+	fmt.Fprintf(w, "session with %s: %s (%s, %d iterations, %d bytes sent, %d received, %d/%d elements missing here/there)\n",
+		peer, status, mapping, result.Iterations, result.BytesSent, result.BytesReceived,
+		len(result.RemoteOnly), len(result.LocalOnly))
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync"
+	"github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync/session"
+)
+
+// writeSetFile writes the elements from..to, except those in skip,
+// to a set file in dir.
+func writeSetFile(t *testing.T, dir, name string, from, to int, skip map[int]bool) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	buf.WriteString("# test set\n\n")
+	for i := from; i <= to; i++ {
+		if !skip[i] {
+			// Mix decimal and hex elements.
+			if i%2 == 0 {
+				fmt.Fprintf(&buf, "%d\n", i)
+			} else {
+				fmt.Fprintf(&buf, "0x%x\n", i)
+			}
+		}
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestServeSyncLoopback(t *testing.T) {
+	for _, mapping := range []string{"egh", "ols"} {
+		t.Run(mapping, func(t *testing.T) {
+			dir := t.TempDir()
+			// The server lacks 10..14, the client lacks 2001..2003.
+			serverSet := writeSetFile(t, dir, "server.txt", 1, 2003,
+				map[int]bool{10: true, 11: true, 12: true, 13: true, 14: true})
+			clientSet := writeSetFile(t, dir, "client.txt", 1, 2000, nil)
+
+			set, err := readSetFile(serverSet)
+			if err != nil {
+				t.Fatalf("readSetFile: %v", err)
+			}
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			serverOut := filepath.Join(dir, "server.diff")
+			served := make(chan error)
+			go func() {
+				served <- serve(context.Background(), ln, session.NewReceiver(set), true, serverOut, io.Discard, io.Discard)
+			}()
+
+			var clientOut, clientLog bytes.Buffer
+			err = run(context.Background(), []string{"sync", "-set", clientSet, "-connect", ln.Addr().String(),
+				"-mapping", mapping, "-universe", "100000"}, &clientOut, &clientLog)
+			if err != nil {
+				t.Fatalf("sync: %v\n%s", err, clientLog.String())
+			}
+			if err := <-served; err != nil {
+				t.Fatalf("serve: %v", err)
+			}
+
+			wantClient := "+2001\n+2002\n+2003\n-10\n-11\n-12\n-13\n-14\n"
+			if clientOut.String() != wantClient {
+				t.Fatalf("client diff:\n%s\nwant:\n%s", clientOut.String(), wantClient)
+			}
+
+			serverDiff, err := os.ReadFile(serverOut)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantServer := "+10\n+11\n+12\n+13\n+14\n-2001\n-2002\n-2003\n"
+			if string(serverDiff) != wantServer {
+				t.Fatalf("server diff:\n%s\nwant:\n%s", serverDiff, wantServer)
+			}
+		})
+	}
+}
+
+func TestServeAppendsDiffOfEachPeer(t *testing.T) {
+	dir := t.TempDir()
+	serverSet := writeSetFile(t, dir, "server.txt", 1, 100, nil)
+	clientSets := []string{
+		writeSetFile(t, dir, "client1.txt", 1, 101, nil),
+		writeSetFile(t, dir, "client2.txt", 1, 102, nil),
+	}
+
+	set, err := readSetFile(serverSet)
+	if err != nil {
+		t.Fatalf("readSetFile: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serverOut := filepath.Join(dir, "server.diff")
+	served := make(chan error)
+	go func() {
+		served <- serve(ctx, ln, session.NewReceiver(set), false, serverOut, io.Discard, io.Discard)
+	}()
+
+	for _, clientSet := range clientSets {
+		var clientLog bytes.Buffer
+		err := run(context.Background(), []string{"sync", "-set", clientSet, "-connect", ln.Addr().String(),
+			"-universe", "1000"}, io.Discard, &clientLog)
+		if err != nil {
+			t.Fatalf("sync: %v\n%s", err, clientLog.String())
+		}
+	}
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+
+	serverDiff, err := os.ReadFile(serverOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var diff []string
+	for _, line := range strings.Split(strings.TrimSpace(string(serverDiff)), "\n") {
+		if strings.HasPrefix(line, "# peer ") {
+			line = "# peer"
+		}
+		diff = append(diff, line)
+	}
+	want := []string{"# peer", "+101", "# peer", "+101", "+102"}
+	if strings.Join(diff, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("server diff:\n%s\nwant the differences with both peers", serverDiff)
+	}
+}
+
+func TestSyncFallsBackToEGH(t *testing.T) {
+	dir := t.TempDir()
+	serverSet := writeSetFile(t, dir, "server.txt", 1, 500, map[int]bool{7: true})
+	clientSet := writeSetFile(t, dir, "client.txt", 1, 500, nil)
+
+	set, err := readSetFile(serverSet)
+	if err != nil {
+		t.Fatalf("readSetFile: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	served := make(chan error)
+	go func() {
+		receiver := session.NewReceiver(set, session.AcceptMappings(EGHMappingName))
+		served <- serve(context.Background(), ln, receiver, true, filepath.Join(dir, "server.diff"), io.Discard, io.Discard)
+	}()
+
+	var clientOut, clientLog bytes.Buffer
+	err = run(context.Background(), []string{"sync", "-set", clientSet, "-connect", ln.Addr().String(),
+		"-mapping", "ols", "-universe", "100000"}, &clientOut, &clientLog)
+	if err != nil {
+		t.Fatalf("sync: %v\n%s", err, clientLog.String())
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+
+	if clientOut.String() != "-7\n" {
+		t.Fatalf("client diff:\n%s\nwant:\n-7", clientOut.String())
+	}
+	if !strings.Contains(clientLog.String(), "done (egh,") {
+		t.Fatalf("client log %q does not report the EGH fallback", clientLog.String())
+	}
+}
+
+func TestServeStopsOnCancel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- serve(ctx, ln, session.NewReceiver(nil), false, "", io.Discard, io.Discard)
+	}()
+
+	// A peer that stalls after connecting.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after cancel")
+	}
+}
+
+func TestSyncReportsFoldedOLS(t *testing.T) {
+	dir := t.TempDir()
+	set := writeSetFile(t, dir, "set.txt", 1, 100, nil)
+
+	elements, err := readSetFile(set)
+	if err != nil {
+		t.Fatalf("readSetFile: %v", err)
+	}
+
+	// The default universe needs an order beyond 64 bits, and 2^96
+	// one beyond the cells practical per iteration.
+	for _, universe := range []string{"", "0x1000000000000000000000000"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+
+		served := make(chan error)
+		go func() {
+			served <- serve(context.Background(), ln, session.NewReceiver(elements), true, filepath.Join(dir, "server.diff"), io.Discard, io.Discard)
+		}()
+
+		args := []string{"sync", "-set", set, "-connect", ln.Addr().String(), "-mapping", "ols"}
+		if universe != "" {
+			args = append(args, "-universe", universe)
+		}
+		var clientLog bytes.Buffer
+		if err := run(context.Background(), args, io.Discard, &clientLog); err != nil {
+			t.Fatalf("sync over %q: %v\n%s", universe, err, clientLog.String())
+		}
+		if err := <-served; err != nil {
+			t.Fatalf("serve: %v", err)
+		}
+
+		for _, want := range []string{"cells per iteration", "ols folded into 10 cells"} {
+			if !strings.Contains(clientLog.String(), want) {
+				t.Fatalf("client log %q does not contain %q", clientLog.String(), want)
+			}
+		}
+	}
+}
+
+func TestSyncRejectsBadInput(t *testing.T) {
+	dir := t.TempDir()
+	set := writeSetFile(t, dir, "set.txt", 1, 10, nil)
+
+	bad := filepath.Join(dir, "bad.txt")
+	if err := os.WriteFile(bad, []byte("1\nfoo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"sync", "-set", bad}, "bad.txt:2"},
+		{[]string{"sync", "-set", set, "-mapping", "hamming"}, "unsupported mapping"},
+		{[]string{"sync", "-set", set, "-universe", "5"}, "outside the universe"},
+		{[]string{"sync"}, "-set is required"},
+		{[]string{"serve", "-set", set, "-mappings", "egh,hamming"}, "unsupported mapping"},
+		{[]string{"fetch"}, "unknown command"},
+	}
+	for _, tt := range tests {
+		err := run(context.Background(), tt.args, io.Discard, io.Discard)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Fatalf("%v: got %v, want an error containing %q", tt.args, err, tt.want)
+		}
+	}
+}
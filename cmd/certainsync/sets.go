@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/holiman/uint256"
+	"github.com/toto9820/Rateless-Set-Reconciliation-with-Listing-Guarantees/certainsync/session"
+)
+
+// readSetFile reads a set file. Duplicate elements are dropped, as
+// they would cancel out in the cells.
+func readSetFile(path string) ([]*uint256.Int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var set []*uint256.Int
+	seen := make(map[uint256.Int]bool)
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		s, err := parseElement(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if !seen[*s] {
+			seen[*s] = true
+			set = append(set, s)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return set, nil
+}
+
+// parseElement parses an element in decimal or 0x-prefixed hex.
+func parseElement(text string) (*uint256.Int, error) {
+	if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+		// uint256 rejects leading zeros in hex.
+		digits := strings.TrimLeft(text[2:], "0")
+		if digits == "" {
+			digits = "0"
+		}
+		return uint256.FromHex("0x" + digits)
+	}
+	return uint256.FromDecimal(text)
+}
+
+// writeDiff writes the difference of a session to the file at path,
+// or to stdout if path is empty. The file is appended to if appendFile
+// is set, and truncated otherwise. If peer is set, the difference
+// follows a comment line naming the peer, so that the differences
+// with several peers can share a file.
+func writeDiff(path string, appendFile bool, stdout io.Writer, peer string, result *session.Result) error {
+	if path == "" {
+		return printDiff(stdout, peer, result)
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendFile {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flag, 0o666)
+	if err != nil {
+		return err
+	}
+	if err := printDiff(f, peer, result); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// printDiff writes the elements only the peer has as +x and those
+// only the local set has as -x, each sorted, after a comment line
+// naming the peer if it is set.
+func printDiff(w io.Writer, peer string, result *session.Result) error {
+	bw := bufio.NewWriter(w)
+	if peer != "" {
+		fmt.Fprintf(bw, "# peer %s\n", peer)
+	}
+	for _, part := range []struct {
+		sign    string
+		symbols []*uint256.Int
+	}{
+		{"+", result.RemoteOnly},
+		{"-", result.LocalOnly},
+	} {
+		sorted := append([]*uint256.Int(nil), part.symbols...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Lt(sorted[j]) })
+		for _, s := range sorted {
+			fmt.Fprintf(bw, "%s%s\n", part.sign, s.Dec())
+		}
+	}
+	return bw.Flush()
+}
@@ -18,8 +18,9 @@ import (
 type MappingType string
 
 const (
-	EGH MappingType = "egh"
-	OLS MappingType = "ols"
+	EGH             MappingType = "egh"
+	OLS             MappingType = "ols"
+	ExtendedHamming MappingType = "extended_hamming"
 )
 
 // TxPoolContent represents the structure of the
@@ -174,7 +175,6 @@ func saveTransactionStatsToCSV(txpoolData TxPoolContent, iteration int, dirPath
 		defer file.Close()
 
 		writer := csv.NewWriter(file)
-		defer writer.Flush()
 
 		// Write header if the file does not exist
 		if !fileExists {
@@ -188,6 +188,11 @@ func saveTransactionStatsToCSV(txpoolData TxPoolContent, iteration int, dirPath
 		if err := writer.Write(record); err != nil {
 			return fmt.Errorf("error writing record to %s: %v", filePath, err)
 		}
+
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return fmt.Errorf("error flushing %s: %v", filePath, err)
+		}
 		return nil
 	}
 
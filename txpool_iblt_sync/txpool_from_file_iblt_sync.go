@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -9,7 +11,10 @@ import (
 	"github.com/holiman/uint256"
 )
 
-func txpool_sync_from_file_certain_sync() {
+// txpool_sync_from_file_certain_sync runs CertainSync on the saved
+// txpools of the two nodes, until ctx is cancelled. A sync in progress
+// is only interrupted once roundCtx is cancelled.
+func txpool_sync_from_file_certain_sync(ctx, roundCtx context.Context) {
 	cwd, err := os.Getwd()
 	if err != nil {
 		log.Fatalf("Failed to get current working directory: %v", err)
@@ -27,12 +32,12 @@ func txpool_sync_from_file_certain_sync() {
 	maxIterations := 15
 	universeSize := uint256.NewInt(0).SetAllOne()
 
-	mappingTypes := []MappingType{EGH}
+	mappingTypes := []MappingType{EGH, OLS}
 
 	for _, mappingType := range mappingTypes {
 		symmetricDiffStatsFilePath := filepath.Join(cwd, "data", "blockchain", fmt.Sprintf("%s_certain_sync_file_symmetric_diff_stats.csv", mappingType))
 
-		for i := 0; i < maxIterations; i++ {
+		for i := 0; i < maxIterations && ctx.Err() == nil; i++ {
 			iterationCount := i + 1
 
 			node1HashesFilePath := filepath.Join(node1Dir, fmt.Sprintf("node1_txpool_hashes_%d.csv", iterationCount))
@@ -41,7 +46,16 @@ func txpool_sync_from_file_certain_sync() {
 			hashes1 := getTransactionsHashesFromFile(node1HashesFilePath)
 			hashes2 := getTransactionsHashesFromFile(node2HashesFilePath)
 
-			symDiffSize, totalCells := certainSync(hashes1, hashes2, universeSize, mappingType)
+			symDiffSize, totalCells, err := certainSync(roundCtx, hashes1, hashes2, universeSize, mappingType)
+			if errors.Is(err, errNotDecoded) {
+				// Only decoded differences go into the stats.
+				log.Printf("MappingType %s, Iteration %d skipped: %v", mappingType, iterationCount, err)
+				continue
+			}
+			if err != nil {
+				log.Printf("MappingType %s, Iteration %d interrupted: %v", mappingType, iterationCount, err)
+				return
+			}
 			fmt.Printf("MappingType %s, Iteration %d: Symmetric Difference: %d\n", mappingType, iterationCount, symDiffSize)
 
 			err = saveSymmetricDiffStatsToCSV(symmetricDiffStatsFilePath, iterationCount, uint64(symDiffSize), totalCells)
@@ -52,7 +66,10 @@ func txpool_sync_from_file_certain_sync() {
 	}
 }
 
-func txpool_sync_from_file_universe_reduce_sync() {
+// txpool_sync_from_file_universe_reduce_sync runs universe reduction
+// sync on the saved txpools of the two nodes, until ctx is cancelled.
+// A sync in progress is only interrupted once roundCtx is cancelled.
+func txpool_sync_from_file_universe_reduce_sync(ctx, roundCtx context.Context) {
 	cwd, err := os.Getwd()
 	if err != nil {
 		log.Fatalf("Failed to get current working directory: %v", err)
@@ -78,7 +95,7 @@ func txpool_sync_from_file_universe_reduce_sync() {
 		1,
 	}
 
-	for i := 0; i < maxIterations; i++ {
+	for i := 0; i < maxIterations && ctx.Err() == nil; i++ {
 		iterationCount := i + 1
 
 		node1HashesFilePath := filepath.Join(node1Dir, fmt.Sprintf("node1_txpool_hashes_%d.csv", iterationCount))
@@ -91,7 +108,16 @@ func txpool_sync_from_file_universe_reduce_sync() {
 			for _, deltaSize := range deltaSizes {
 				symmetricDiffStatsFilePath := filepath.Join(cwd, "data", "blockchain", fmt.Sprintf("%s_universe_reduce_sync_file_symmetric_diff_stats_delta_%d.csv", mappingType, uint64(deltaSize)))
 
-				symDiffSize, totalTransmittedBits := universeReduceSync(hashes1, hashes2, deltaSize, mappingType)
+				symDiffSize, totalTransmittedBits, err := universeReduceSync(roundCtx, hashes1, hashes2, deltaSize, mappingType)
+				if errors.Is(err, errNotDecoded) {
+					// Only decoded differences go into the stats.
+					log.Printf("MappingType %s, Iteration %d, Delta Size %d skipped: %v", mappingType, iterationCount, uint64(deltaSize), err)
+					continue
+				}
+				if err != nil {
+					log.Printf("MappingType %s, Iteration %d, Delta Size %d interrupted: %v", mappingType, iterationCount, uint64(deltaSize), err)
+					return
+				}
 				fmt.Printf("MappingType %s, Iteration %d, Delta Size %d: Symmetric Difference: %d, Total Transmitted Bits: %d\n", mappingType, iterationCount, uint64(deltaSize), symDiffSize, totalTransmittedBits)
 
 				err = saveSymmetricDiffStatsToCSV(symmetricDiffStatsFilePath, iterationCount, uint64(symDiffSize), totalTransmittedBits)
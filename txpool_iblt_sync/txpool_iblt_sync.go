@@ -4,10 +4,12 @@ import (
 	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"time"
 
@@ -39,54 +41,105 @@ func loadConfig(filePath string) (*Config, error) {
 	return &config, nil
 }
 
+// errNotDecoded is returned by the sync functions when the mapping
+// runs out of iterations before the difference is decoded.
+var errNotDecoded = errors.New("symmetric difference not decoded")
+
 // certainSync generates IBFs for two sets of
 // transaction hashes, compares them, and finds the
-// symmetric difference.
-func certainSync(hashes1, hashes2 []*uint256.Int, universeSize *uint256.Int, mappingType MappingType) (int, uint64) {
+// symmetric difference. It returns the error of ctx,
+// along with what it decoded so far, if ctx is
+// cancelled first, and errNotDecoded if the mapping
+// runs out of iterations.
+func certainSync(ctx context.Context, hashes1, hashes2 []*uint256.Int, universeSize *uint256.Int, mappingType MappingType) (int, uint64, error) {
 	var ibfNode1, ibfNode2 *InvertibleBloomFilter
 
+	maxSetSize := max(len(hashes1), len(hashes2))
+
 	var mapping MappingMethod
 	switch mappingType {
 	case EGH:
 		mapping = &EGHMapping{}
 	case OLS:
-		mapping = &OLSMapping{
-			Order: uint64(math.Ceil(math.Sqrt(float64(universeSize.Uint64())))),
+		// Squares of raw transaction hashes (order 2^128) are folded
+		// into about sqrt(n) cells per iteration, see OLSMapping.
+		ols := &OLSMapping{
+			Order: OLSOrderForUniverse(universeSize),
+			Cells: uint64(math.Ceil(math.Sqrt(float64(maxSetSize)))),
+		}
+		if ols.Folded() {
+			log.Printf("OLS order %s folded into %d cells per iteration",
+				ols.Order.Dec(), ols.GetAdditionalCellsCount(1))
 		}
+		mapping = ols
+	case ExtendedHamming:
+		mapping = &ExtendedHammingMapping{UniverseSize: universeSize}
 	default:
 		panic("unsupported mapping type")
 	}
 
-	ibfNode1 = NewIBF(universeSize, mapping)
-	ibfNode2 = NewIBF(universeSize, mapping)
+	// Counts only need to hold the size of the larger txpool.
+	countBits := WithMaxSetSize(uint64(maxSetSize))
+
+	ibfNode1 = NewIBF(universeSize, mapping, countBits)
+	ibfNode2 = NewIBF(universeSize, mapping, countBits)
+
+	// Node2 decodes the difference from node1's transmitted batches,
+	// keeping what it peeled between iterations.
+	decoder := NewIncrementalDecoder(universeSize, mapping, countBits)
 
 	transmittedBits := uint64(0)
+	symDiffSize := 0
+
+	var result *DecodeResult
 
 	for {
-		ibfNode1.AddSymbols(hashes1)
+		if err := ctx.Err(); err != nil {
+			return symDiffSize, transmittedBits, err
+		}
+
+		batch, err := ibfNode1.AddSymbols(hashes1)
+		if err != nil {
+			// Mappings with a bounded number of iterations (OLS,
+			// Extended Hamming) cannot list larger differences.
+			log.Printf("%s mapping stopped after %d iterations: %v", mappingType, ibfNode1.Iteration, err)
+			if result != nil {
+				log.Printf("last decode peeled %d symbols, %d false purities, undecodable iterations %v",
+					result.PeelingSteps, result.FalsePurities, result.UndecodableIterations)
+			}
+			return symDiffSize, transmittedBits, fmt.Errorf("%w: %w", errNotDecoded, err)
+		}
 
-		transmittedBits += ibfNode1.GetTransmittedBitsSize()
+		transmittedBits += batch.BitsLen(ibfNode1.Layout)
 
-		ibfNode2.AddSymbols(hashes2)
+		batch2, err := ibfNode2.AddSymbols(hashes2)
+		if err != nil {
+			panic(err)
+		}
 
-		// Subtract the two IBFs
-		ibfDiff := ibfNode2.Subtract(ibfNode1)
-		hashes2Not1, hashes1Not2, ok := ibfDiff.Decode()
+		// Subtract the two batches
+		if err := decoder.AddBatches(batch2, batch); err != nil {
+			panic(err)
+		}
+		result, err = decoder.Decode()
+		symDiffSize = len(result.BWithoutA) + len(result.AWithoutB)
 
-		if ok {
+		if err == nil {
 			// Sending back to node1 transactions of 2/1 where each
 			// transaction is 256 bit.
-			transmittedBits += uint64(len(hashes2Not1)) * 256
+			transmittedBits += uint64(len(result.BWithoutA)) * 256
 
-			return len(hashes2Not1) + len(hashes1Not2), transmittedBits
+			return symDiffSize, transmittedBits, nil
 		}
 	}
 }
 
 // UniverseReduceSync compares two sets of transaction hashes using Invertible Bloom Filters
 // and finds their symmetric difference. It supports different mapping methods (EGH or OLS).
-// Returns the size of the symmetric difference and the total number of transmitted bits.
-func universeReduceSync(originalHashes1, originalHashes2 []*uint256.Int, delta float64, mappingType MappingType) (int, uint64) {
+// Returns the size of the symmetric difference and the total number of transmitted bits,
+// or, if ctx is cancelled first, those found so far along with the error of ctx.
+// It returns errNotDecoded if the mapping of a round runs out of iterations.
+func universeReduceSync(ctx context.Context, originalHashes1, originalHashes2 []*uint256.Int, delta float64, mappingType MappingType) (int, uint64, error) {
 	// Create working copies of the input slices
 	totalHashes1 := make([]*uint256.Int, len(originalHashes1))
 	totalHashes2 := make([]*uint256.Int, len(originalHashes2))
@@ -102,10 +155,8 @@ func universeReduceSync(originalHashes1, originalHashes2 []*uint256.Int, delta f
 	for {
 		var sizeS1, sizeS2 uint64
 		var convertedHashes2Not1, convertedHashes1Not2 []*uint256.Int
-		var ok bool
 		var roundSymmetricDiffSize int
 		var roundTransmittedBits uint64 = 0
-		var ibfDiff *InvertibleBloomFilter
 
 		sizeS1 = uint64(len(totalHashes1))
 		sizeS2 = uint64(len(totalHashes2))
@@ -118,8 +169,10 @@ func universeReduceSync(originalHashes1, originalHashes2 []*uint256.Int, delta f
 			mapping = &EGHMapping{}
 		case OLS:
 			mapping = &OLSMapping{
-				Order: uint64(math.Ceil(math.Sqrt(float64(reducedUniverSizeUint64)))),
+				Order: OLSOrderForUniverse(reducedUniverseSize),
 			}
+		case ExtendedHamming:
+			mapping = &ExtendedHammingMapping{UniverseSize: reducedUniverseSize}
 		default:
 			panic("unsupported mapping type")
 		}
@@ -129,24 +182,44 @@ func universeReduceSync(originalHashes1, originalHashes2 []*uint256.Int, delta f
 		convertedHashes1, hashMap1 := certainMapping(totalHashes1, roundNumber, reducedUniverseSize)
 		convertedHashes2, hashMap2 := certainMapping(totalHashes2, roundNumber, reducedUniverseSize)
 
-		ibfNode1 := NewIBF(reducedUniverseSize, mapping)
-		ibfNode2 := NewIBF(reducedUniverseSize, mapping)
+		countBits := WithMaxSetSize(max(sizeS1, sizeS2))
+
+		ibfNode1 := NewIBF(reducedUniverseSize, mapping, countBits)
+		ibfNode2 := NewIBF(reducedUniverseSize, mapping, countBits)
+		decoder := NewIncrementalDecoder(reducedUniverseSize, mapping, countBits)
 
 		for {
-			ibfNode1.AddSymbols(convertedHashes1)
+			if err := ctx.Err(); err != nil {
+				return len(allHashes1Not2) + len(allHashes2Not1), transmittedBits + roundTransmittedBits, err
+			}
 
-			roundTransmittedBits = ibfNode1.GetTransmittedBitsSize()
+			batch, err := ibfNode1.AddSymbols(convertedHashes1)
+			if err != nil {
+				// Mappings with a bounded number of iterations (OLS,
+				// Extended Hamming) cannot list larger differences.
+				log.Printf("%s mapping stopped after %d iterations: %v", mappingType, ibfNode1.Iteration, err)
+				return len(allHashes1Not2) + len(allHashes2Not1), transmittedBits + roundTransmittedBits,
+					fmt.Errorf("%w in round %d: %w", errNotDecoded, roundNumber, err)
+			}
 
-			ibfNode2.AddSymbols(convertedHashes2)
+			roundTransmittedBits += batch.BitsLen(ibfNode1.Layout)
 
-			// Subtract the two IBFs
-			ibfDiff = ibfNode2.Subtract(ibfNode1)
-			convertedHashes2Not1, convertedHashes1Not2, ok = ibfDiff.Decode()
+			batch2, err := ibfNode2.AddSymbols(convertedHashes2)
+			if err != nil {
+				panic(err)
+			}
+
+			// Subtract the two batches
+			if err := decoder.AddBatches(batch2, batch); err != nil {
+				panic(err)
+			}
+			result, err := decoder.Decode()
+			convertedHashes2Not1, convertedHashes1Not2 = result.BWithoutA, result.AWithoutB
 
 			roundSymmetricDiffSize = len(convertedHashes2Not1) + len(convertedHashes1Not2)
 
 			// Checking if IBLT of symmmetric difference is empty
-			if ok {
+			if err == nil {
 				break
 			}
 		}
@@ -189,7 +262,7 @@ func universeReduceSync(originalHashes1, originalHashes2 []*uint256.Int, delta f
 
 		if roundSymmetricDiffSize == 0 {
 			totalDiffSize := len(allHashes1Not2) + len(allHashes2Not1)
-			return totalDiffSize, transmittedBits
+			return totalDiffSize, transmittedBits, nil
 		}
 
 		roundNumber++
@@ -355,7 +428,6 @@ func saveSymmetricDiffStatsToCSV(filePath string, iterationCount int, symDiffSiz
 	defer file.Close()
 
 	writer := csv.NewWriter(file)
-	defer writer.Flush()
 
 	// Write header if the file does not exist
 	if !fileExists {
@@ -378,12 +450,17 @@ func saveSymmetricDiffStatsToCSV(filePath string, iterationCount int, symDiffSiz
 		return err
 	}
 
-	return nil
+	// Rows are flushed as they are written, so that the stats
+	// survive an interrupted run.
+	writer.Flush()
+	return writer.Error()
 }
 
 // txpool_sync performs TxPool synchronization between
-// two blockchain nodes in real time.
-func txpool_sync() {
+// two blockchain nodes in real time, until its run time
+// is over or ctx is cancelled. A round in progress is
+// only interrupted once roundCtx is cancelled.
+func txpool_sync(ctx, roundCtx context.Context) {
 	cwd, err := os.Getwd()
 	if err != nil {
 		log.Fatalf("Failed to get current working directory: %v", err)
@@ -420,26 +497,26 @@ func txpool_sync() {
 
 	// Set the duration for how long the
 	// process should run (1 hour)
-	// 	endTime := time.Now().Add(time.Hour + time.Minute)
+	// 	ctx, cancel := context.WithTimeout(ctx, time.Hour+time.Minute)
 
 	// just for check
-	endTime := time.Now().Add(3 * time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Minute)
+	defer cancel()
 
 	iterationCount := 0
 
 	// mappingTypes := []MappingType{EGH, OLS}
 
-	for time.Now().Before(endTime) {
+	for ctx.Err() == nil {
 		iterationCount++
 
-		ctx := context.Background()
-		txpool1Data, err := fetchTxPoolContent(node1, ctx)
+		txpool1Data, err := fetchTxPoolContent(node1, roundCtx)
 		if err != nil {
 			log.Printf("Failed to fetch txpool content for Node 1: %v", err)
 			continue
 		}
 
-		txpool2Data, err := fetchTxPoolContent(node2, ctx)
+		txpool2Data, err := fetchTxPoolContent(node2, roundCtx)
 		if err != nil {
 			log.Printf("Failed to fetch txpool content for Node 2: %v", err)
 			continue
@@ -468,31 +545,95 @@ func txpool_sync() {
 			log.Printf("Error saving Node 2 stats to CSV: %v", err)
 		}
 
-		// relevant only for egh for now (ols universe reduction)
+		// Raw transaction hashes span the whole 256-bit universe.
 		universeSize := uint256.NewInt(0).SetAllOne()
 
-		// TODO - fix later to support other mapping types.
-		symDiffSize, totalCells := certainSync(hashes1, hashes2, universeSize, EGH)
-		fmt.Printf("Iteration %d: Symmetric Difference: %d\n", iterationCount, symDiffSize)
+		symDiffSize, totalCells, err := certainSync(roundCtx, hashes1, hashes2, universeSize, EGH)
+		switch {
+		case errors.Is(err, errNotDecoded):
+			// Only decoded differences go into the stats.
+			log.Printf("Iteration %d skipped: %v", iterationCount, err)
+		case err != nil:
+			log.Printf("Iteration %d interrupted: %v", iterationCount, err)
+			return
+		default:
+			fmt.Printf("Iteration %d: Symmetric Difference: %d\n", iterationCount, symDiffSize)
 
-		err = saveSymmetricDiffStatsToCSV(symmetricDiffStatsFilePath, iterationCount, uint64(symDiffSize), totalCells)
-		if err != nil {
-			log.Printf("Error saving symmetric difference stats to CSV: %v", err)
+			err = saveSymmetricDiffStatsToCSV(symmetricDiffStatsFilePath, iterationCount, uint64(symDiffSize), totalCells)
+			if err != nil {
+				log.Printf("Error saving symmetric difference stats to CSV: %v", err)
+			}
 		}
 
-		// time.Sleep(10 * time.Second)
-		time.Sleep(time.Minute)
+		if !waitNextRound(ctx, roundCtx) {
+			return
+		}
+	}
+}
+
+// waitNextRound waits for the next round of txpool_sync,
+// and reports whether there is one.
+func waitNextRound(ctx, roundCtx context.Context) bool {
+	// timer := time.NewTimer(10 * time.Second)
+	timer := time.NewTimer(time.Minute)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return ctx.Err() == nil
+	case <-ctx.Done():
+		return false
+	case <-roundCtx.Done():
+		return false
+	}
+}
+
+// interruptContexts returns a context cancelled by the
+// first SIGINT, after which sync loops finish their
+// current round and return, and a context cancelled by
+// the second, which interrupts the round in progress.
+func interruptContexts() (ctx, roundCtx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	roundCtx, cancelRound := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt)
+
+	go func() {
+		select {
+		case <-signals:
+			log.Print("Interrupted, finishing the current round (interrupt again to abort it)")
+			cancel()
+		case <-roundCtx.Done():
+			return
+		}
+
+		select {
+		case <-signals:
+			log.Print("Interrupted again, aborting the current round")
+			cancelRound()
+		case <-roundCtx.Done():
+		}
+	}()
+
+	return ctx, roundCtx, func() {
+		signal.Stop(signals)
+		cancel()
+		cancelRound()
 	}
 }
 
 func main() {
-	// txpool_sync()
+	ctx, roundCtx, stop := interruptContexts()
+	defer stop()
+
+	// txpool_sync(ctx, roundCtx)
 
 	// txpool_sync_from_nodes_certain_sync()
 
 	// txpool_sync_from_nodes_universe_reduce_sync()
 
-	// txpool_sync_from_file_certain_sync()
+	// txpool_sync_from_file_certain_sync(ctx, roundCtx)
 
-	txpool_sync_from_file_universe_reduce_sync()
+	txpool_sync_from_file_universe_reduce_sync(ctx, roundCtx)
 }